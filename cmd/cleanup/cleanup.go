@@ -0,0 +1,36 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"log/slog"
+
+	"github.com/ncthompson/ThingsWeather/configuration"
+	"github.com/ncthompson/ThingsWeather/interfaces/influxif"
+)
+
+// One-off removal of the zero rain and pressure values written for nodes
+// that do not have those sensors.
+func main() {
+	configFile := flag.String("config", "config.json", "Configuration file location.")
+	dryRun := flag.Bool("dry-run", false, "Report phantom zeros without deleting them.")
+	flag.Parse()
+
+	config, err := configuration.OpenConfig(*configFile)
+	if err != nil {
+		log.Fatalf("Failed to open configuration: %v.\n", err)
+	}
+
+	inf, err := influxif.NewClient(config.DbConfig)
+	if err != nil {
+		log.Fatalf("Failed to start Influxdb client: %v\n", err)
+	}
+	deleted, err := inf.DeletePhantomZeros(*dryRun)
+	inf.Close()
+	for name, n := range deleted {
+		slog.Info("Phantom zeros removed", "measurement", name, "removed", n)
+	}
+	if err != nil {
+		log.Fatalf("Cleanup failed: %v\n", err)
+	}
+}
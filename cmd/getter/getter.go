@@ -1,8 +1,12 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"log"
+	"log/slog"
+	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
@@ -10,13 +14,27 @@ import (
 
 	sysd "github.com/coreos/go-systemd/daemon"
 	"github.com/ncthompson/ThingsWeather/configuration"
-	"github.com/ncthompson/ThingsWeather/interfaces/influxif"
+	"github.com/ncthompson/ThingsWeather/interfaces/api"
+	"github.com/ncthompson/ThingsWeather/interfaces/metrics"
+	"github.com/ncthompson/ThingsWeather/interfaces/sink"
 	"github.com/ncthompson/ThingsWeather/interfaces/thingsif"
 )
 
+const (
+	// shutdownTimeout bounds draining the pipeline and sinks on shutdown.
+	shutdownTimeout = 30 * time.Second
+	// stateInterval is how often the checkpoint and duplicate filter are
+	// saved while running.
+	stateInterval = time.Minute
+)
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "sync" {
+		os.Exit(syncCommand(os.Args[2:]))
+	}
 	createTemplate := flag.Bool("template", false, "Create sample configuration template.")
 	configFile := flag.String("config", "config.json", "Configuration file location.")
+	history := flag.String("history", "", "History window to sync at startup, e.g. 36h or 7d. Overrides the configuration.")
 	flag.Parse()
 	if *createTemplate {
 		err := configuration.CreateConfigTemplate()
@@ -30,73 +48,200 @@ func main() {
 	if err != nil {
 		log.Fatalf("Failed to open configuration: %v.\n", err)
 	}
+	if *history != "" {
+		_, err = thingsif.ParseWindow(*history)
+		if err != nil {
+			log.Fatalf("Invalid history window: %v.\n", err)
+		}
+		config.MConfig.HistoryWindow = *history
+	}
+	err = config.Log.SetupLogging(os.Stderr)
+	if err != nil {
+		log.Fatalf("Invalid log configuration: %v.\n", err)
+	}
 
 	mqtt, err := thingsif.NewClient(config.MConfig)
 	if err != nil {
-		log.Fatalf("Failed to start MQTT client: %v\n", err)
+		fatal("Failed to start MQTT client", err)
+	}
+	sinks, err := config.OpenSinks()
+	if err != nil {
+		fatal("Failed to start sinks", err)
+	}
+	var apiServer *api.Server
+	if config.API {
+		if config.HTTPAddr == "" {
+			fatal("Failed to start API", errors.New("API requires HTTPAddr"))
+		}
+		apiServer = api.NewServer(sinks)
+		sinks.Add("api", apiServer)
+	}
+	devices, err := config.OpenDevices()
+	if err != nil {
+		fatal("Failed to open device registry", err)
 	}
-	inf, err := influxif.NewClient(config.DbConfig)
+
+	checkpoint, err := config.OpenCheckpoint()
+	if err != nil {
+		fatal("Failed to open checkpoint", err)
+	}
+
+	dedup, err := config.OpenDedup()
+	if err != nil {
+		fatal("Failed to open duplicate filter", err)
+	}
+
+	loss, err := config.OpenLoss()
 	if err != nil {
-		log.Fatalf("Failed to start Influxdb client: %v\n", err)
+		fatal("Failed to start packet loss statistics", err)
 	}
 
-	hist, err := mqtt.GetLast7days()
+	hist, err := mqtt.GetHistory(checkpoint.Get(mqtt.AppID()))
 	if err != nil {
-		log.Printf("Could not sync old data: %v", err)
+		slog.Warn("Could not sync old data", "err", err)
 	} else {
-		_ = inf.SyncDatabase(hist)
+		devices.Fill(hist)
+		err = sinks.SyncDatabase(hist)
+		if err == nil {
+			checkpoint.Stored(hist)
+			saveCheckpoint(checkpoint)
+		}
 	}
 
-	go updater(mqtt, inf)
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+	p := &pipeline{
+		mqtt:    mqtt,
+		out:     sinks,
+		devices: devices,
+		dedup:   dedup,
+		loss:    loss,
+		started: time.Now().UnixNano(),
+	}
+	p.lastDone.Store(p.started)
+	maxSilence := time.Duration(0)
+	if config.MaxSilence != "" {
+		maxSilence, err = thingsif.ParseWindow(config.MaxSilence)
+		if err != nil {
+			fatal("Invalid MaxSilence", err)
+		}
+	}
+	h := &health{p: p, mqtt: mqtt, sinks: sinks, maxSilence: maxSilence}
+	finished := make(chan struct{})
+	go func() {
+		p.run(ctx)
+		close(finished)
+	}()
+	go monitorQueue(mqtt)
+	go saveState(ctx, dedup, checkpoint, sinks)
+	registerClientMetrics(mqtt)
+	serveHTTP(config.HTTPAddr, h, apiServer)
 	_, err = sysd.SdNotify(false, "READY=1")
 	if err != nil {
-		log.Printf("Could not signal systemd: %v", err)
+		slog.Warn("Could not signal systemd", "err", err)
 	}
+	go h.notify(ctx)
 
-	termChan := make(chan os.Signal, 1)
-	signal.Notify(termChan, syscall.SIGTERM, syscall.SIGINT)
-	<-termChan
+	<-ctx.Done()
+	// A second signal kills the getter instead of waiting for the drain.
+	stop()
+	_, _ = sysd.SdNotify(false, "STOPPING=1")
 	go func() {
-		time.Sleep(10 * time.Second)
-		panic("Unclean shutdown.")
+		time.Sleep(shutdownTimeout)
+		slog.Error("Unclean shutdown, drain took too long", "timeout", shutdownTimeout)
+		os.Exit(1)
 	}()
-	mqtt.Close()
-	inf.Close()
-	log.Print("Graceful shutdown.")
+	<-finished
+	sinks.Close()
+	err = devices.Save()
+	if err != nil {
+		slog.Error("Could not save device registry", "err", err)
+	}
+	advanceCheckpoint(checkpoint, sinks)
+	saveDedup(dedup)
+	queue := mqtt.QueueStats()
+	buffered := sinks.Pending()
+	slog.Info("Graceful shutdown", "drained", p.drained.Load(), "spilled", queue.Spilled,
+		"buffered", buffered, "failed", p.failed.Load())
 	os.Exit(0)
 }
 
-func updater(mqtt *thingsif.MQTTCli, inf *influxif.InfluxIf) {
-	for {
-		var nodeData *thingsif.Message
-		var err error
-		nodeData, err = mqtt.WaitForData()
+// serveHTTP serves /metrics, /healthz, /readyz and, when apiServer is set,
+// /api/ in the background when addr is set.
+func serveHTTP(addr string, h *health, apiServer *api.Server) {
+	if addr == "" {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler())
+	mux.Handle("/healthz", h.handler(false))
+	mux.Handle("/readyz", h.handler(true))
+	if apiServer != nil {
+		mux.Handle("/api/", apiServer.Handler())
+	}
+	go func() {
+		slog.Info("HTTP server listening", "addr", addr)
+		err := http.ListenAndServe(addr, mux)
 		if err != nil {
-			log.Printf("Error: %v", err)
-			continue
+			slog.Error("HTTP server failed", "err", err)
+		}
+	}()
+}
+
+// monitorQueue logs the receive queue while it is backed up or dropping.
+func monitorQueue(mqtt *thingsif.MQTTCli) {
+	var last thingsif.QueueStats
+	for range time.Tick(time.Minute) {
+		stats := mqtt.QueueStats()
+		if stats.Depth > stats.Capacity/2 || stats.Spilled > 0 || stats.Dropped != last.Dropped {
+			slog.Warn("Receive queue backed up", "depth", stats.Depth, "capacity", stats.Capacity,
+				"spilled", stats.Spilled, "dropped", stats.Dropped)
 		}
-		if nodeData != nil && nodeData.PayloadFields != nil {
-			if nodeData.PayloadFields.Valid {
-				log.Printf("Node: %v\n", nodeData.DevID)
-				log.Printf("Time: %v\n", nodeData.Metadata.Time)
-				log.Printf("Temperature: %v\n", nodeData.PayloadFields.Temp)
-				log.Printf("Humidity: %v\n", nodeData.PayloadFields.Humid)
-				log.Printf("Battery: %v\n", nodeData.PayloadFields.Bat)
-				log.Printf("Rain: %v\n", nodeData.PayloadFields.Rain)
-				log.Printf("Pressure: %v\n", nodeData.PayloadFields.Pres)
-				thingsif.PrintGatways(nodeData.Metadata.Gateways)
-				err = inf.WriteToDatabase(nodeData)
-				if err != nil {
-					log.Printf("Batch point error: %v\n", err)
-				}
-			} else {
-				log.Printf("Invalid Gateway")
-				log.Printf("Time: %v\n", nodeData.Metadata.Time)
-				log.Printf("Temperature: %v\n", nodeData.PayloadFields.Temp)
-				log.Printf("Humidity: %v\n", nodeData.PayloadFields.Humid)
-				log.Printf("Battery: %v\n", nodeData.PayloadFields.Bat)
-				log.Printf("Rain: %v\n", nodeData.PayloadFields.Rain)
-			}
+		last = stats
+	}
+}
+
+// saveState saves the duplicate filter and the checkpoint every
+// stateInterval until ctx is done.
+func saveState(ctx context.Context, dedup *thingsif.Dedup, checkpoint *thingsif.Checkpoint, sinks *sink.Fanout) {
+	ticker := time.NewTicker(stateInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			saveDedup(dedup)
+			advanceCheckpoint(checkpoint, sinks)
 		}
 	}
 }
+
+// advanceCheckpoint moves the checkpoint up to what all sinks stored and
+// saves it.
+func advanceCheckpoint(checkpoint *thingsif.Checkpoint, sinks *sink.Fanout) {
+	for app, t := range sinks.Stored() {
+		checkpoint.Set(app, t)
+	}
+	saveCheckpoint(checkpoint)
+}
+
+// fatal logs err and exits.
+func fatal(msg string, err error) {
+	slog.Error(msg, "err", err)
+	os.Exit(1)
+}
+
+func saveCheckpoint(checkpoint *thingsif.Checkpoint) {
+	err := checkpoint.Save()
+	if err != nil {
+		slog.Error("Could not save checkpoint", "err", err)
+	}
+}
+
+func saveDedup(dedup *thingsif.Dedup) {
+	err := dedup.Save()
+	if err != nil {
+		slog.Error("Could not save duplicate filter", "err", err)
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	sysd "github.com/coreos/go-systemd/daemon"
+	"github.com/ncthompson/ThingsWeather/interfaces/sink"
+	"github.com/ncthompson/ThingsWeather/interfaces/thingsif"
+)
+
+// wedgeTimeout is how long messages may wait without any leaving the
+// pipeline, or a sink may spend on one write, before it counts as wedged.
+// Tests shorten it.
+var wedgeTimeout = 2 * time.Minute
+
+// statusInterval is how often STATUS= is sent to systemd.
+const statusInterval = 30 * time.Second
+
+// health judges the getter from its pipeline, MQTT client and sinks.
+type health struct {
+	p     *pipeline
+	mqtt  client
+	sinks *sink.Fanout
+	// maxSilence marks the getter not ready when no uplink arrived for
+	// this long, zero to ignore.
+	maxSilence time.Duration
+}
+
+type healthReport struct {
+	Healthy       bool
+	Ready         bool
+	MQTTConnected bool
+	Wedged        bool
+	// SinceLastUplink is empty until the first uplink.
+	SinceLastUplink string `json:",omitempty"`
+	Queue           thingsif.QueueStats
+	Sinks           []sink.SinkHealth
+	Problems        []string `json:",omitempty"`
+}
+
+// wedged reports messages waiting without any leaving the pipeline, or a
+// sink stuck on a write. The pipeline hands observations to the sink
+// queues without waiting, so it keeps moving while a sink hangs.
+func (h *health) wedged() bool {
+	waiting := h.p.inflight.Load() > 0 || h.mqtt.QueueStats().Depth > 0
+	if waiting && time.Since(time.Unix(0, h.p.lastDone.Load())) > wedgeTimeout {
+		return true
+	}
+	return h.sinks.Busy() > wedgeTimeout
+}
+
+func (h *health) sinceLastUplink() (time.Duration, bool) {
+	last := h.p.lastReceived.Load()
+	if last == 0 {
+		return 0, false
+	}
+	return time.Since(time.Unix(0, last)), true
+}
+
+func (h *health) report() healthReport {
+	r := healthReport{
+		MQTTConnected: h.mqtt.Connected(),
+		Wedged:        h.wedged(),
+		Queue:         h.mqtt.QueueStats(),
+		Sinks:         h.sinks.Health(),
+	}
+	r.Healthy = !r.Wedged
+	r.Ready = r.Healthy && r.MQTTConnected
+	if r.Wedged {
+		r.Problems = append(r.Problems, fmt.Sprintf("no message processed or sink write finished for %v", wedgeTimeout))
+	}
+	if !r.MQTTConnected {
+		r.Problems = append(r.Problems, "MQTT disconnected")
+	}
+	for _, s := range r.Sinks {
+		if !s.Healthy {
+			r.Ready = false
+			r.Problems = append(r.Problems, fmt.Sprintf("sink %v failing", s.Name))
+		}
+	}
+	since, ok := h.sinceLastUplink()
+	if ok {
+		r.SinceLastUplink = since.Round(time.Second).String()
+	}
+	if h.maxSilence > 0 {
+		// Before the first uplink, count the silence from startup.
+		if !ok {
+			since = time.Since(time.Unix(0, h.p.started))
+		}
+		if since > h.maxSilence {
+			r.Ready = false
+			r.Problems = append(r.Problems, fmt.Sprintf("no uplink for %v", since.Round(time.Second)))
+		}
+	}
+	return r
+}
+
+// handler serves the report, with 503 when the getter is not healthy or,
+// for readiness, not ready.
+func (h *health) handler(readiness bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		report := h.report()
+		ok := report.Healthy
+		if readiness {
+			ok = report.Ready
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if !ok {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "\t")
+		_ = enc.Encode(report)
+	}
+}
+
+// notify pings the systemd watchdog while the pipeline is not wedged and
+// keeps STATUS= up to date until ctx is done.
+func (h *health) notify(ctx context.Context) {
+	interval, err := sysd.SdWatchdogEnabled(false)
+	if err != nil {
+		slog.Warn("Watchdog disabled", "err", err)
+	}
+	var watchdog <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval / 2)
+		defer ticker.Stop()
+		watchdog = ticker.C
+	}
+	status := time.NewTicker(statusInterval)
+	defer status.Stop()
+	lastWritten, lastFailed := h.p.written.Load(), h.p.failed.Load()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-watchdog:
+			if h.wedged() {
+				slog.Error("Pipeline wedged, not notifying the watchdog")
+				continue
+			}
+			_, _ = sysd.SdNotify(false, "WATCHDOG=1")
+		case <-status.C:
+			written, failed := h.p.written.Load(), h.p.failed.Load()
+			_, _ = sysd.SdNotify(false, "STATUS="+h.status(written-lastWritten, failed-lastFailed))
+			lastWritten, lastFailed = written, failed
+		}
+	}
+}
+
+// status summarises throughput since the last status.
+func (h *health) status(written, failed uint64) string {
+	conn := "connected"
+	if !h.mqtt.Connected() {
+		conn = "disconnected"
+	}
+	queue := h.mqtt.QueueStats()
+	s := fmt.Sprintf("MQTT %v; %v written, %v failed in %v; queue %v/%v",
+		conn, written, failed, statusInterval, queue.Depth, queue.Capacity)
+	if since, ok := h.sinceLastUplink(); ok {
+		s += fmt.Sprintf("; last uplink %v ago", since.Round(time.Second))
+	}
+	return s
+}
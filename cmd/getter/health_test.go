@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/ncthompson/ThingsWeather/interfaces/sink"
+	"github.com/ncthompson/ThingsWeather/interfaces/thingsif"
+)
+
+// blockingSink hangs in Write until released.
+type blockingSink struct {
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (s *blockingSink) Write(obs *sink.Observation) error {
+	s.entered <- struct{}{}
+	<-s.release
+	return nil
+}
+
+func (s *blockingSink) Close() {}
+
+func obsAt(counter int) *sink.Observation {
+	u, _ := (&fakeClient{}).Decode(&thingsif.Received{Payload: []byte(strconv.Itoa(counter)), Time: t0})
+	return sink.FromUplink(u)
+}
+
+func TestHealthBlockedSink(t *testing.T) {
+	defer func(d time.Duration) { wedgeTimeout = d }(wedgeTimeout)
+	wedgeTimeout = 50 * time.Millisecond
+
+	s := &blockingSink{entered: make(chan struct{}, 1), release: make(chan struct{})}
+	sinks := &sink.Fanout{}
+	sinks.Add("blocked", s)
+	defer sinks.Close()
+	defer close(s.release)
+	p := newTestPipeline(t, newFakeClient(0), sinks)
+	h := &health{p: p, mqtt: p.mqtt, sinks: sinks}
+
+	if r := h.report(); !r.Healthy || !r.Ready {
+		t.Fatalf("idle getter reported %+v", r)
+	}
+	err := sinks.Write(obsAt(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-s.entered
+	// The fanout queues without waiting, so the pipeline keeps moving
+	// while the sink hangs.
+	p.lastDone.Store(time.Now().UnixNano())
+	time.Sleep(2 * wedgeTimeout)
+
+	r := h.report()
+	if r.Healthy || !r.Wedged {
+		t.Errorf("blocked sink reported %+v", r)
+	}
+	rec := httptest.NewRecorder()
+	h.handler(false).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("healthz answered %v, want %v", rec.Code, http.StatusServiceUnavailable)
+	}
+}
+
+func TestHealthPipelineStalled(t *testing.T) {
+	defer func(d time.Duration) { wedgeTimeout = d }(wedgeTimeout)
+	wedgeTimeout = 50 * time.Millisecond
+
+	sinks := &sink.Fanout{}
+	defer sinks.Close()
+	p := newTestPipeline(t, newFakeClient(0), sinks)
+	h := &health{p: p, mqtt: p.mqtt, sinks: sinks}
+
+	p.inflight.Add(1)
+	p.lastDone.Store(time.Now().Add(-2 * wedgeTimeout).UnixNano())
+	if r := h.report(); r.Healthy || !r.Wedged {
+		t.Errorf("stalled pipeline reported %+v", r)
+	}
+	p.inflight.Add(-1)
+	if r := h.report(); !r.Healthy || r.Wedged {
+		t.Errorf("idle pipeline reported %+v", r)
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"github.com/ncthompson/ThingsWeather/interfaces/metrics"
+	"github.com/ncthompson/ThingsWeather/interfaces/thingsif"
+)
+
+var (
+	uplinksReceived = metrics.NewCounter("thingsweather_uplinks_received_total",
+		"MQTT messages received.")
+	uplinksDecoded = metrics.NewCounter("thingsweather_uplinks_decoded_total",
+		"Uplinks with a decoded payload.")
+	uplinksInvalid = metrics.NewCounter("thingsweather_uplinks_invalid_total",
+		"Uplinks whose payload was marked invalid.")
+	uplinksDuplicate = metrics.NewCounterVec("thingsweather_uplinks_duplicate_total",
+		"Duplicate uplinks dropped per device.", "device")
+	uplinkDelay = metrics.NewHistogramVec("thingsweather_uplink_delay_seconds",
+		"Time from the network receiving an uplink to the getter receiving it.",
+		[]float64{.1, .25, .5, 1, 2.5, 5, 10, 30, 60, 300})
+	deviceLastSeen = metrics.NewGaugeVec("thingsweather_device_last_seen_timestamp_seconds",
+		"Time of the last uplink per device.", "device")
+	packetLoss = metrics.NewGaugeVec("thingsweather_packet_loss_ratio",
+		"Fraction of frames missed per device and window.", "device", "window")
+)
+
+// registerClientMetrics exposes the state of the MQTT client.
+func registerClientMetrics(mqtt *thingsif.MQTTCli) {
+	metrics.NewGaugeFunc("thingsweather_mqtt_connected",
+		"Whether the MQTT client is connected to the broker.", func() float64 {
+			if mqtt.Connected() {
+				return 1
+			}
+			return 0
+		})
+	metrics.NewGaugeFunc("thingsweather_queue_depth",
+		"Messages waiting in memory between MQTT and processing.", func() float64 {
+			return float64(mqtt.QueueStats().Depth)
+		})
+	metrics.NewGaugeFunc("thingsweather_queue_capacity",
+		"Size of the in-memory receive queue.", func() float64 {
+			return float64(mqtt.QueueStats().Capacity)
+		})
+	metrics.NewGaugeFunc("thingsweather_queue_spilled",
+		"Messages spilled to disk by the receive queue.", func() float64 {
+			return float64(mqtt.QueueStats().Spilled)
+		})
+	metrics.NewCounterFunc("thingsweather_queue_dropped_total",
+		"Messages dropped by the receive queue.", func() float64 {
+			return float64(mqtt.QueueStats().Dropped)
+		})
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ncthompson/ThingsWeather/interfaces/sink"
+	"github.com/ncthompson/ThingsWeather/interfaces/thingsif"
+)
+
+// stageDepth is the number of messages each stage may run ahead of the
+// next.
+const stageDepth = 16
+
+// client is the part of the MQTT client the pipeline and its health
+// checks use.
+type client interface {
+	Receive() (*thingsif.Received, error)
+	Decode(msg *thingsif.Received) (*thingsif.Uplink, error)
+	Connected() bool
+	QueueStats() thingsif.QueueStats
+	Close()
+}
+
+// pipeline moves uplinks from MQTT to the sinks in stages:
+// receive → decode → enrich → sink. Each stage runs on its own goroutine
+// and closes its output when its input is exhausted, so stopping intake
+// drains everything in flight to the sinks.
+type pipeline struct {
+	mqtt    client
+	out     sink.Sink
+	devices *thingsif.DeviceRegistry
+	dedup   *thingsif.Dedup
+	loss    *thingsif.LossTracker
+
+	stopping atomic.Bool
+	// written and failed count sink writes, drained those made after
+	// intake stopped.
+	written atomic.Uint64
+	failed  atomic.Uint64
+	drained atomic.Uint64
+	// inflight counts messages received but not yet through the pipeline,
+	// lastReceived and lastDone are the Unix nanoseconds a message last
+	// entered and left it.
+	inflight     atomic.Int64
+	lastReceived atomic.Int64
+	lastDone     atomic.Int64
+	started      int64
+}
+
+// finish records a message leaving the pipeline, written or not.
+func (p *pipeline) finish() {
+	p.inflight.Add(-1)
+	p.lastDone.Store(time.Now().UnixNano())
+}
+
+// run processes uplinks until ctx is done, then stops intake and returns
+// once the messages in flight reached the sinks.
+func (p *pipeline) run(ctx context.Context) {
+	raw := make(chan *thingsif.Received, stageDepth)
+	uplinks := make(chan *thingsif.Uplink, stageDepth)
+	obs := make(chan *sink.Observation, stageDepth)
+
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			slog.Info("Stopping intake, draining pipeline")
+			p.stopping.Store(true)
+			p.mqtt.Close()
+		case <-done:
+		}
+	}()
+
+	var wg sync.WaitGroup
+	wg.Add(4)
+	go func() {
+		defer wg.Done()
+		p.receive(raw)
+	}()
+	go func() {
+		defer wg.Done()
+		p.decode(raw, uplinks)
+	}()
+	go func() {
+		defer wg.Done()
+		p.enrich(uplinks, obs)
+	}()
+	go func() {
+		defer wg.Done()
+		p.write(obs)
+	}()
+	wg.Wait()
+	close(done)
+}
+
+func (p *pipeline) receive(out chan<- *thingsif.Received) {
+	defer close(out)
+	for {
+		msg, err := p.mqtt.Receive()
+		if errors.Is(err, thingsif.ErrClosed) {
+			return
+		}
+		if err != nil {
+			slog.Error("Receive failed", "err", err)
+			continue
+		}
+		uplinksReceived.Inc()
+		p.inflight.Add(1)
+		p.lastReceived.Store(msg.Time.UnixNano())
+		out <- msg
+	}
+}
+
+func (p *pipeline) decode(in <-chan *thingsif.Received, out chan<- *thingsif.Uplink) {
+	defer close(out)
+	for msg := range in {
+		nodeData, err := p.mqtt.Decode(msg)
+		if err != nil {
+			slog.Warn("Could not decode uplink", "topic", msg.Topic, "err", err)
+			p.finish()
+			continue
+		}
+		if nodeData == nil {
+			p.finish()
+			continue
+		}
+		if nodeData.Payload != nil {
+			uplinksDecoded.Inc()
+		}
+		if !nodeData.Time.IsZero() {
+			uplinkDelay.Observe(nodeData.Received.Sub(nodeData.Time).Seconds())
+		}
+		out <- nodeData
+	}
+}
+
+// enrich drops duplicates, adds packet loss and keeps the device registry
+// up to date. Only uplinks with a valid payload are passed on.
+func (p *pipeline) enrich(in <-chan *thingsif.Uplink, out chan<- *sink.Observation) {
+	defer close(out)
+	for nodeData := range in {
+		epoch, dup := p.dedup.Check(nodeData)
+		if dup {
+			stats := p.dedup.Stats()[nodeData.DevID]
+			slog.Info("Duplicate uplink", "device", nodeData.DevID, "counter", nodeData.Counter,
+				"duplicates", stats.Duplicates)
+			uplinksDuplicate.Inc(nodeData.DevID)
+			p.finish()
+			continue
+		}
+		if !nodeData.Time.IsZero() {
+			deviceLastSeen.Set(float64(nodeData.Time.UnixNano())/1e9, nodeData.DevID)
+		}
+		link := p.loss.Update(nodeData, epoch)
+		for _, g := range link.Gaps {
+			slog.Info("Missed frames", "device", nodeData.DevID, "first", g.First, "last", g.Last,
+				"missed", g.Missed())
+		}
+		for _, w := range link.Windows {
+			packetLoss.Set(w.Loss, nodeData.DevID, w.Window)
+		}
+		if nodeData.Payload == nil {
+			p.finish()
+			continue
+		}
+		if !nodeData.Payload.Valid {
+			uplinksInvalid.Inc()
+			slog.Warn("Invalid uplink", uplinkAttrs(nodeData)...)
+			p.finish()
+			continue
+		}
+		p.devices.Update(nodeData)
+		err := p.devices.Save()
+		if err != nil {
+			slog.Error("Could not save device registry", "err", err)
+		}
+		slog.Info("Uplink", uplinkAttrs(nodeData)...)
+		thingsif.PrintGatways(nodeData.Gateways)
+		o := sink.FromUplink(nodeData)
+		o.Link = link
+		out <- o
+	}
+}
+
+func (p *pipeline) write(in <-chan *sink.Observation) {
+	for o := range in {
+		err := p.out.Write(o)
+		p.finish()
+		if err != nil {
+			p.failed.Add(1)
+			slog.Error("Sink write failed", "station", o.Station, "err", err)
+			continue
+		}
+		p.written.Add(1)
+		if p.stopping.Load() {
+			p.drained.Add(1)
+		}
+	}
+}
+
+// uplinkAttrs are the attributes of the one record logged per uplink.
+func uplinkAttrs(u *thingsif.Uplink) []any {
+	fields := make([]any, 0, len(u.Payload.Measurements))
+	for _, m := range u.Payload.Measurements {
+		name := m.Name
+		if m.Channel != "" {
+			name += "/" + m.Channel
+		}
+		fields = append(fields, slog.Float64(name, m.Value))
+	}
+	return []any{
+		"device", u.DevID,
+		"counter", u.Counter,
+		"port", u.Port,
+		"time", u.Time,
+		slog.Group("fields", fields...),
+		"gateways", len(u.Gateways),
+	}
+}
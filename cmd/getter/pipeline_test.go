@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ncthompson/ThingsWeather/interfaces/sink"
+	"github.com/ncthompson/ThingsWeather/interfaces/thingsif"
+)
+
+var t0 = time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+// fakeClient hands out queued messages like the MQTT client: once closed
+// the messages already queued are still received, then ErrClosed.
+type fakeClient struct {
+	msgs      chan *thingsif.Received
+	once      sync.Once
+	connected bool
+}
+
+func newFakeClient(n int) *fakeClient {
+	c := &fakeClient{msgs: make(chan *thingsif.Received, n), connected: true}
+	for i := 1; i <= n; i++ {
+		c.msgs <- &thingsif.Received{Topic: "app/devices/node/up", Payload: []byte(strconv.Itoa(i)), Time: t0}
+	}
+	return c
+}
+
+func (c *fakeClient) Receive() (*thingsif.Received, error) {
+	msg, ok := <-c.msgs
+	if !ok {
+		return nil, thingsif.ErrClosed
+	}
+	return msg, nil
+}
+
+// Decode turns a message holding a frame counter into a valid uplink.
+func (c *fakeClient) Decode(msg *thingsif.Received) (*thingsif.Uplink, error) {
+	counter, err := strconv.Atoi(string(msg.Payload))
+	if err != nil {
+		return nil, err
+	}
+	payload := &thingsif.Payload{Valid: true}
+	payload.Add(thingsif.MeasTemperature, 20, "degC")
+	return &thingsif.Uplink{
+		AppID:    "app",
+		DevID:    "node",
+		Counter:  counter,
+		Time:     t0.Add(time.Duration(counter) * time.Minute),
+		Received: msg.Time,
+		Payload:  payload,
+	}, nil
+}
+
+func (c *fakeClient) Connected() bool {
+	return c.connected
+}
+
+func (c *fakeClient) QueueStats() thingsif.QueueStats {
+	return thingsif.QueueStats{Depth: len(c.msgs), Capacity: cap(c.msgs)}
+}
+
+func (c *fakeClient) Close() {
+	c.once.Do(func() { close(c.msgs) })
+}
+
+// recordSink records the counters written and how many were written when
+// it was closed.
+type recordSink struct {
+	mu      sync.Mutex
+	written []int
+	closed  bool
+	atClose int
+	late    int
+}
+
+func (s *recordSink) Write(obs *sink.Observation) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		s.late++
+	}
+	s.written = append(s.written, obs.Uplink.Counter)
+	return nil
+}
+
+func (s *recordSink) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	s.atClose = len(s.written)
+}
+
+func newTestPipeline(t *testing.T, mqtt client, out sink.Sink) *pipeline {
+	t.Helper()
+	devices, err := thingsif.OpenDeviceRegistry("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dedup, err := thingsif.OpenDedup(thingsif.DedupConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	loss, err := thingsif.NewLossTracker(thingsif.LossConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &pipeline{
+		mqtt:    mqtt,
+		out:     out,
+		devices: devices,
+		dedup:   dedup,
+		loss:    loss,
+		started: time.Now().UnixNano(),
+	}
+	p.lastDone.Store(p.started)
+	return p
+}
+
+func TestPipelineDrainsOnShutdown(t *testing.T) {
+	const queued = 50
+	s := &recordSink{}
+	sinks := &sink.Fanout{}
+	sinks.Add("record", s)
+	p := newTestPipeline(t, newFakeClient(queued), sinks)
+
+	// Shutdown starts with every message still queued in the client.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	p.run(ctx)
+	sinks.Close()
+
+	if !s.closed {
+		t.Fatal("sink not closed")
+	}
+	if s.atClose != queued || s.late != 0 {
+		t.Errorf("%v of %v messages written before close, %v after", s.atClose, queued, s.late)
+	}
+	for i, counter := range s.written {
+		if counter != i+1 {
+			t.Fatalf("got counters %v, want them in order", s.written)
+		}
+	}
+	if got := p.written.Load(); got != queued {
+		t.Errorf("pipeline counted %v writes, want %v", got, queued)
+	}
+	if got := p.inflight.Load(); got != 0 {
+		t.Errorf("%v messages still in flight", got)
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/ncthompson/ThingsWeather/configuration"
+	"github.com/ncthompson/ThingsWeather/interfaces/sink"
+	"github.com/ncthompson/ThingsWeather/interfaces/thingsif"
+)
+
+const syncUsage = `Usage: getter sync [-config file] [-app id] [-from time] [-to time] [-dry-run]
+
+Pulls history from the storage integration and writes the uplinks missing
+from the sinks. Times are RFC 3339, a date such as 2006-01-02, or a window
+before now such as 36h or 3d. Exits non-zero when a sink could not be
+backfilled completely.
+`
+
+// syncCommand runs the sync subcommand and returns the exit code.
+func syncCommand(args []string) int {
+	flags := flag.NewFlagSet("sync", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprint(flags.Output(), syncUsage)
+		flags.PrintDefaults()
+	}
+	configFile := flags.String("config", "config.json", "Configuration file location.")
+	app := flags.String("app", "", "Application ID. Defaults to the configured application.")
+	fromArg := flags.String("from", "", "Start of the history. Defaults to the storage retention.")
+	toArg := flags.String("to", "", "End of the history. Defaults to now.")
+	dryRun := flags.Bool("dry-run", false, "Report gaps without filling them.")
+	_ = flags.Parse(args)
+
+	config, err := configuration.OpenConfig(*configFile)
+	if err != nil {
+		slog.Error("Failed to open configuration", "err", err)
+		return 1
+	}
+	err = config.Log.SetupLogging(os.Stderr)
+	if err != nil {
+		slog.Error("Invalid log configuration", "err", err)
+		return 1
+	}
+	history, err := thingsif.NewHistory(config.MConfig)
+	if err != nil {
+		slog.Error("Failed to start history client", "err", err)
+		return 1
+	}
+	if *app == "" {
+		*app = history.AppID()
+	}
+	retention, err := history.Retention()
+	if err != nil {
+		slog.Error("Invalid storage retention", "err", err)
+		return 1
+	}
+
+	now := time.Now()
+	to := now
+	if *toArg != "" {
+		to, err = parseTime(*toArg, now)
+		if err != nil {
+			slog.Error("Invalid -to", "err", err)
+			return 1
+		}
+	}
+	from := now.Add(-retention)
+	if *fromArg != "" {
+		from, err = parseTime(*fromArg, now)
+		if err != nil {
+			slog.Error("Invalid -from", "err", err)
+			return 1
+		}
+	}
+	if !from.Before(to) {
+		slog.Error("Empty range", "from", from.Format(time.RFC3339), "to", to.Format(time.RFC3339))
+		return 1
+	}
+	if from.Before(now.Add(-retention)) {
+		slog.Warn("History before the storage retention may be missing", "retention", retention,
+			"since", now.Add(-retention).Format(time.RFC3339))
+	}
+
+	hist, err := history.Fetch(*app, from, to)
+	if err != nil {
+		slog.Error("Failed to fetch history", "err", err)
+		return 1
+	}
+	devices, err := config.OpenDevices()
+	if err != nil {
+		slog.Error("Failed to open device registry", "err", err)
+		return 1
+	}
+	devices.Fill(hist)
+
+	confs, err := config.SinkConfigs()
+	if err != nil {
+		slog.Error("Failed to start sinks", "err", err)
+		return 1
+	}
+	// The running getter owns the write-ahead buffers, so write directly
+	// and let a failure show in the exit code instead.
+	for i := range confs {
+		confs[i].Buffer = nil
+	}
+	sinks, err := sink.NewFanout(confs)
+	if err != nil {
+		slog.Error("Failed to start sinks", "err", err)
+		return 1
+	}
+	reports, err := sinks.Backfill(hist, *dryRun)
+	sinks.Close()
+
+	failed := err != nil
+	printReport(reports, *dryRun)
+	for _, counts := range reports {
+		for _, c := range counts {
+			if !*dryRun && c.Inserted < c.Missing {
+				failed = true
+			}
+		}
+	}
+	if failed {
+		slog.Error("Sync incomplete")
+		return 1
+	}
+	return 0
+}
+
+// parseTime parses an absolute time or a window before now.
+func parseTime(s string, now time.Time) (time.Time, error) {
+	t, err := time.Parse(time.RFC3339, s)
+	if err == nil {
+		return t, nil
+	}
+	t, err = time.ParseInLocation("2006-01-02", s, time.Local)
+	if err == nil {
+		return t, nil
+	}
+	window, err := thingsif.ParseWindow(s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %q", s)
+	}
+	return now.Add(-window), nil
+}
+
+func printReport(reports map[string]map[string]*sink.SyncCount, dryRun bool) {
+	names := make([]string, 0, len(reports))
+	for name := range reports {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		counts := reports[name]
+		devs := make([]string, 0, len(counts))
+		for dev := range counts {
+			devs = append(devs, dev)
+		}
+		sort.Strings(devs)
+		fmt.Printf("%v:\n", name)
+		for _, dev := range devs {
+			c := counts[dev]
+			if dryRun {
+				fmt.Printf("  %v: %v missing, %v present, %v invalid\n", dev, c.Missing, c.Skipped, c.Invalid)
+			} else {
+				fmt.Printf("  %v: %v missing, %v filled, %v present, %v invalid\n", dev, c.Missing, c.Inserted, c.Skipped, c.Invalid)
+			}
+		}
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"log/slog"
+
+	"github.com/ncthompson/ThingsWeather/configuration"
+	"github.com/ncthompson/ThingsWeather/interfaces/influxif"
+)
+
+// Copies data stored with one measurement per value into the weather and
+// radio measurements used by the wide schema.
+func main() {
+	configFile := flag.String("config", "config.json", "Configuration file location.")
+	dryRun := flag.Bool("dry-run", false, "Print the migration statements without running them.")
+	flag.Parse()
+
+	config, err := configuration.OpenConfig(*configFile)
+	if err != nil {
+		log.Fatalf("Failed to open configuration: %v.\n", err)
+	}
+
+	inf, err := influxif.NewClient(config.DbConfig)
+	if err != nil {
+		log.Fatalf("Failed to start Influxdb client: %v\n", err)
+	}
+	err = inf.MigrateToWide(*dryRun)
+	inf.Close()
+	if err != nil {
+		log.Fatalf("Migration failed: %v\n", err)
+	}
+	slog.Info("Migration done")
+}
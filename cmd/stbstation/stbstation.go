@@ -3,13 +3,23 @@ package main
 import (
 	"flag"
 	"log"
+	"log/slog"
+	"net/http"
+	"os"
 	"time"
 
 	"github.com/ncthompson/ThingsWeather/configuration"
-	"github.com/ncthompson/ThingsWeather/interfaces/influxif"
+	"github.com/ncthompson/ThingsWeather/interfaces/metrics"
 	"github.com/ncthompson/ThingsWeather/interfaces/stbsource"
 )
 
+var (
+	polls = metrics.NewCounter("thingsweather_stb_polls_total",
+		"Polls of the weather.sun.ac.za station.")
+	pollFailures = metrics.NewCounter("thingsweather_stb_poll_failures_total",
+		"Polls of the weather.sun.ac.za station that failed.")
+)
+
 func main() {
 	configFile := flag.String("config", "config.json", "Configuration file location.")
 	updateRate := flag.Int("rate", 30, "Set the update rate in seconds")
@@ -19,20 +29,38 @@ func main() {
 	if err != nil {
 		log.Fatalf("Failed to open configuraion: %v.\n", err)
 	}
+	err = config.Log.SetupLogging(os.Stderr)
+	if err != nil {
+		log.Fatalf("Invalid log configuration: %v.\n", err)
+	}
 
-	inf, err := influxif.NewClient(config.DbConfig)
+	sinks, err := config.OpenSinks()
 	if err != nil {
-		log.Fatalf("Failed to start Influxdb client: %v\n", err)
+		slog.Error("Failed to start sinks", "err", err)
+		os.Exit(1)
+	}
+	if config.HTTPAddr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", metrics.Handler())
+		go func() {
+			slog.Info("HTTP server listening", "addr", config.HTTPAddr)
+			err := http.ListenAndServe(config.HTTPAddr, mux)
+			if err != nil {
+				slog.Error("HTTP server failed", "err", err)
+			}
+		}()
 	}
 	ticker := time.NewTicker(time.Duration(*updateRate) * time.Second)
 	for range ticker.C {
 		measure, err := stbsource.GetStbSource()
+		polls.Inc()
 		if err != nil {
-			log.Printf("ERROR: %v\n", err)
+			pollFailures.Inc()
+			slog.Error("Station poll failed", "err", err)
 		} else {
-			err = inf.WriteStbToDatabase(measure)
+			err = sinks.Write(measure.Observation())
 			if err != nil {
-				log.Printf("ERROR: %v\n", err)
+				slog.Error("Sink write failed", "err", err)
 			}
 		}
 	}
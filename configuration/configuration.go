@@ -5,12 +5,88 @@ import (
 	"os"
 
 	"github.com/ncthompson/ThingsWeather/interfaces/influxif"
+	"github.com/ncthompson/ThingsWeather/interfaces/sink"
 	"github.com/ncthompson/ThingsWeather/interfaces/thingsif"
 )
 
 type GetterConfig struct {
 	DbConfig influxif.InfluxConfig
 	MConfig  thingsif.MQTTConfig
+	// Sinks to write observations to. When empty DbConfig is used as the
+	// only sink.
+	Sinks []sink.Config
+	// Buffer of the DbConfig sink, used when Sinks is empty.
+	Buffer *sink.BufferConfig
+	// DeviceFile persists the identity of devices seen live, used to tag
+	// history the same as live uplinks.
+	DeviceFile string
+	// Devices seeds the device registry.
+	Devices []thingsif.DeviceInfo
+	// CheckpointFile persists the time of the last stored uplink so the
+	// startup sync only fetches history since then.
+	CheckpointFile string
+	// Dedup configures the duplicate uplink filter.
+	Dedup thingsif.DedupConfig
+	// Loss configures the per device packet loss statistics.
+	Loss thingsif.LossConfig
+	// HTTPAddr to serve /metrics, /healthz and /readyz on, e.g. :9110.
+	// Disabled when empty.
+	HTTPAddr string
+	// API serves current conditions and history under /api/ on HTTPAddr.
+	API bool
+	// MaxSilence marks the getter not ready when no uplink arrived for
+	// this long, e.g. 1h. Ignored when empty.
+	MaxSilence string
+	// Log configures the level and format of the log.
+	Log LogConfig
+}
+
+// OpenDedup opens the duplicate uplink filter.
+func (c *GetterConfig) OpenDedup() (*thingsif.Dedup, error) {
+	return thingsif.OpenDedup(c.Dedup)
+}
+
+// OpenLoss creates the packet loss tracker.
+func (c *GetterConfig) OpenLoss() (*thingsif.LossTracker, error) {
+	return thingsif.NewLossTracker(c.Loss)
+}
+
+// OpenCheckpoint opens the history checkpoint.
+func (c *GetterConfig) OpenCheckpoint() (*thingsif.Checkpoint, error) {
+	return thingsif.OpenCheckpoint(c.CheckpointFile)
+}
+
+// OpenDevices opens the device registry and adds the configured devices.
+func (c *GetterConfig) OpenDevices() (*thingsif.DeviceRegistry, error) {
+	reg, err := thingsif.OpenDeviceRegistry(c.DeviceFile)
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range c.Devices {
+		reg.Add(d)
+	}
+	return reg, nil
+}
+
+// SinkConfigs returns the configured sinks, falling back to DbConfig.
+func (c *GetterConfig) SinkConfigs() ([]sink.Config, error) {
+	if len(c.Sinks) > 0 {
+		return c.Sinks, nil
+	}
+	db, err := json.Marshal(c.DbConfig)
+	if err != nil {
+		return nil, err
+	}
+	return []sink.Config{{Type: "influx", Name: "influx", Config: db, Buffer: c.Buffer}}, nil
+}
+
+// OpenSinks opens all configured sinks behind a single fan out.
+func (c *GetterConfig) OpenSinks() (*sink.Fanout, error) {
+	confs, err := c.SinkConfigs()
+	if err != nil {
+		return nil, err
+	}
+	return sink.NewFanout(confs)
 }
 
 func sampleConfig() GetterConfig {
@@ -22,13 +98,30 @@ func sampleConfig() GetterConfig {
 	}
 
 	mq := thingsif.MQTTConfig{
-		Username: "application_id",
-		Password: "access_key",
+		Username:      "application_id",
+		Password:      "access_key",
+		Format:        thingsif.FormatV2,
+		Topic:         "+/devices/+/up",
+		ClientID:      "thingsweather",
+		HistoryWindow: "7d",
+		Decoders: []thingsif.DecoderRule{
+			{Decoder: "frame", Port: 1},
+		},
+		Queue: thingsif.QueueConfig{
+			Size:     1024,
+			Overflow: thingsif.OverflowBlock,
+		},
+	}
+
+	loss := thingsif.LossConfig{
+		Windows: thingsif.DefaultLossWindows,
 	}
 
 	conf := GetterConfig{
 		MConfig:  mq,
 		DbConfig: db,
+		Loss:     loss,
+		Log:      LogConfig{Level: "info", Format: "text"},
 	}
 	return conf
 }
@@ -50,19 +143,13 @@ func CreateConfigTemplate() error {
 }
 
 func OpenConfig(file string) (*GetterConfig, error) {
-	f, err := os.Open(file)
+	data, err := os.ReadFile(file)
 	if err != nil {
 		return nil, err
 	}
-	defer f.Close()
 
 	conf := &GetterConfig{}
-	data := make([]byte, 4096)
-	n, err := f.Read(data)
-	if err != nil {
-		return nil, err
-	}
-	err = json.Unmarshal(data[0:n], conf)
+	err = json.Unmarshal(data, conf)
 	if err != nil {
 		return nil, err
 	}
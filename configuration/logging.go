@@ -0,0 +1,62 @@
+package configuration
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+)
+
+// LogConfig configures the structured log.
+type LogConfig struct {
+	// Level is debug, info (default), warn or error.
+	Level string
+	// Format is text (default) or json.
+	Format string
+}
+
+// secretKeys are attribute keys whose values are never logged.
+var secretKeys = map[string]bool{
+	"password":   true,
+	"token":      true,
+	"access_key": true,
+	"accesskey":  true,
+}
+
+// redact replaces the value of secret attributes.
+func redact(groups []string, a slog.Attr) slog.Attr {
+	if secretKeys[strings.ToLower(a.Key)] {
+		return slog.String(a.Key, "REDACTED")
+	}
+	return a
+}
+
+// NewLogger creates a logger writing to w as configured.
+func (c LogConfig) NewLogger(w io.Writer) (*slog.Logger, error) {
+	level := slog.LevelInfo
+	if c.Level != "" {
+		err := level.UnmarshalText([]byte(c.Level))
+		if err != nil {
+			return nil, fmt.Errorf("unknown log level: %v", c.Level)
+		}
+	}
+	opts := &slog.HandlerOptions{Level: level, ReplaceAttr: redact}
+	switch c.Format {
+	case "", "text":
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	}
+	return nil, fmt.Errorf("unknown log format: %v", c.Format)
+}
+
+// SetupLogging makes the configured logger the default, which the log
+// package writes through as well.
+func (c LogConfig) SetupLogging(w io.Writer) error {
+	logger, err := c.NewLogger(w)
+	if err != nil {
+		return err
+	}
+	slog.SetDefault(logger)
+	return nil
+}
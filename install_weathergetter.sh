@@ -26,7 +26,8 @@ ExecStart=/opt/thingsweather/getter -config=/etc/thingsweather/config.json
 RestartSec=5
 Restart=always
 TimeoutStartSec=30
-TimeoutStopSec=10
+TimeoutStopSec=35
+WatchdogSec=300
 User=thingsweather
 Group=thingsweather
 OOMScoreAdjust=100
@@ -0,0 +1,268 @@
+// Package api serves the latest observation of every station and the
+// stored history over HTTP as JSON.
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ncthompson/ThingsWeather/interfaces/sink"
+	"github.com/ncthompson/ThingsWeather/interfaces/thingsif"
+)
+
+// defaultHistory is the history returned when no start time is given.
+const defaultHistory = 24 * time.Hour
+
+// Server is a sink that keeps the latest valid observation per station and
+// serves:
+//
+//	/api/stations                    the current conditions of all stations
+//	/api/stations/{id}/current       the current conditions of one station
+//	/api/stations/{id}/history       stored rows, ?from&to in RFC 3339 and
+//	                                 ?fields comma separated
+type Server struct {
+	q sink.Querier
+
+	mu     sync.RWMutex
+	latest map[string]*sink.Observation
+}
+
+// Gateway is a gateway that received the last uplink.
+type Gateway struct {
+	ID      string  `json:"id"`
+	RSSI    float64 `json:"rssi"`
+	SNR     float64 `json:"snr"`
+	Channel int     `json:"channel"`
+}
+
+// Radio is the radio quality of the last uplink, best over all gateways.
+type Radio struct {
+	Counter   int       `json:"counter"`
+	Frequency float64   `json:"frequency"`
+	DataRate  string    `json:"dataRate"`
+	RSSI      float64   `json:"rssi"`
+	SNR       float64   `json:"snr"`
+	Gateways  []Gateway `json:"gateways"`
+}
+
+// Station holds the current conditions of a station.
+type Station struct {
+	ID           string                  `json:"id"`
+	LastSeen     time.Time               `json:"lastSeen"`
+	Measurements []*thingsif.Measurement `json:"measurements"`
+	// Radio is nil for stations not on LoRa.
+	Radio *Radio `json:"radio,omitempty"`
+}
+
+// History holds the stored rows of a station.
+type History struct {
+	ID   string    `json:"id"`
+	From time.Time `json:"from"`
+	To   time.Time `json:"to"`
+	// Units of the fields, as far as known from the current observation.
+	Units map[string]string `json:"units"`
+	Rows  []sink.Row        `json:"rows"`
+}
+
+// NewServer creates a server reading history from q, nil when there is no
+// storage to query.
+func NewServer(q sink.Querier) *Server {
+	return &Server{
+		q:      q,
+		latest: make(map[string]*sink.Observation),
+	}
+}
+
+// Write keeps the observation when it is the newest valid one of its
+// station.
+func (s *Server) Write(obs *sink.Observation) error {
+	if obs.Payload == nil || !obs.Payload.Valid {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	last := s.latest[obs.Station]
+	if last == nil || !obs.Time.Before(last.Time) {
+		s.latest[obs.Station] = obs
+	}
+	return nil
+}
+
+// Close does nothing, the server keeps answering until the process exits.
+func (s *Server) Close() {
+}
+
+func (s *Server) current(id string) (*sink.Observation, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	obs, ok := s.latest[id]
+	return obs, ok
+}
+
+// Handler serves the API under /api/.
+func (s *Server) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/"), "/")
+		parts := strings.Split(path, "/")
+		switch {
+		case path == "stations":
+			s.stations(w)
+		case len(parts) == 3 && parts[0] == "stations" && parts[2] == "current":
+			s.station(w, parts[1])
+		case len(parts) == 3 && parts[0] == "stations" && parts[2] == "history":
+			s.history(w, r, parts[1])
+		default:
+			writeError(w, http.StatusNotFound, "not found")
+		}
+	})
+}
+
+func (s *Server) stations(w http.ResponseWriter) {
+	s.mu.RLock()
+	list := make([]Station, 0, len(s.latest))
+	for _, obs := range s.latest {
+		list = append(list, station(obs))
+	}
+	s.mu.RUnlock()
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].ID < list[j].ID
+	})
+	writeJSON(w, http.StatusOK, list)
+}
+
+func (s *Server) station(w http.ResponseWriter, id string) {
+	obs, ok := s.current(id)
+	if !ok {
+		writeError(w, http.StatusNotFound, "unknown station "+id)
+		return
+	}
+	writeJSON(w, http.StatusOK, station(obs))
+}
+
+func (s *Server) history(w http.ResponseWriter, r *http.Request, id string) {
+	if s.q == nil {
+		writeError(w, http.StatusNotImplemented, "no storage supports history")
+		return
+	}
+	query := r.URL.Query()
+	to := time.Now().UTC()
+	from := to.Add(-defaultHistory)
+	var err error
+	if v := query.Get("to"); v != "" {
+		to, err = time.Parse(time.RFC3339, v)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid to: "+err.Error())
+			return
+		}
+		from = to.Add(-defaultHistory)
+	}
+	if v := query.Get("from"); v != "" {
+		from, err = time.Parse(time.RFC3339, v)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid from: "+err.Error())
+			return
+		}
+	}
+	if from.After(to) {
+		writeError(w, http.StatusBadRequest, "from is after to")
+		return
+	}
+
+	obs, _ := s.current(id)
+	var fields []string
+	if v := query.Get("fields"); v != "" {
+		for _, f := range strings.Split(v, ",") {
+			f = strings.TrimSpace(f)
+			if f != "" {
+				fields = append(fields, f)
+			}
+		}
+	} else if obs != nil {
+		for _, m := range obs.Payload.Measurements {
+			fields = append(fields, key(m))
+		}
+	} else {
+		fields = []string{thingsif.MeasTemperature, thingsif.MeasHumidity, thingsif.MeasPressure,
+			thingsif.MeasRain, thingsif.MeasBattery}
+	}
+
+	rows, err := s.q.Query(id, from, to, fields)
+	if errors.Is(err, sink.ErrNoQuerier) {
+		writeError(w, http.StatusNotImplemented, "no storage supports history")
+		return
+	}
+	if err != nil {
+		slog.Warn("History query failed", "station", id, "err", err)
+		writeError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+	h := History{ID: id, From: from, To: to, Units: make(map[string]string), Rows: rows}
+	if obs != nil {
+		for _, m := range obs.Payload.Measurements {
+			if m.Unit != "" {
+				h.Units[key(m)] = m.Unit
+			}
+		}
+	}
+	writeJSON(w, http.StatusOK, h)
+}
+
+// key names a measurement like the history rows do.
+func key(m *thingsif.Measurement) string {
+	if m.Channel == "" {
+		return m.Name
+	}
+	return m.Name + "/" + m.Channel
+}
+
+func station(obs *sink.Observation) Station {
+	st := Station{
+		ID:           obs.Station,
+		LastSeen:     obs.Time,
+		Measurements: obs.Payload.Measurements,
+	}
+	u := obs.Uplink
+	if u == nil {
+		return st
+	}
+	radio := &Radio{
+		Counter:   u.Counter,
+		Frequency: u.Frequency,
+		DataRate:  u.DataRate,
+		Gateways:  make([]Gateway, 0, len(u.Gateways)),
+	}
+	for i, g := range u.Gateways {
+		if i == 0 || g.RSSI > radio.RSSI {
+			radio.RSSI = g.RSSI
+		}
+		if i == 0 || g.SNR > radio.SNR {
+			radio.SNR = g.SNR
+		}
+		radio.Gateways = append(radio.Gateways, Gateway{ID: g.GtwID, RSSI: g.RSSI, SNR: g.SNR, Channel: g.Channel})
+	}
+	st.Radio = radio
+	return st
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "\t")
+	_ = enc.Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
@@ -0,0 +1,202 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ncthompson/ThingsWeather/interfaces/sink"
+	"github.com/ncthompson/ThingsWeather/interfaces/thingsif"
+)
+
+// fakeQuerier records the last query and answers it with rows or err.
+type fakeQuerier struct {
+	station  string
+	from, to time.Time
+	fields   []string
+	rows     []sink.Row
+	err      error
+}
+
+func (q *fakeQuerier) Query(station string, from, to time.Time, fields []string) ([]sink.Row, error) {
+	q.station, q.from, q.to, q.fields = station, from, to, fields
+	return q.rows, q.err
+}
+
+var t0 = time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+func observation(station string, t time.Time, valid bool) *sink.Observation {
+	p := &thingsif.Payload{Valid: valid}
+	p.Add(thingsif.MeasTemperature, 20.5, "degC")
+	p.Add(thingsif.MeasTemperature, 18, "degC").Channel = "2"
+	return &sink.Observation{Station: station, Time: t, Payload: p, Uplink: &thingsif.Uplink{
+		Counter: 7, Frequency: 868.1, DataRate: "SF7BW125",
+		Gateways: []*thingsif.GwMetadata{
+			{GtwID: "gw1", RSSI: -100, SNR: 2, Channel: 1},
+			{GtwID: "gw2", RSSI: -80, SNR: -1, Channel: 3},
+		},
+	}}
+}
+
+func get(t *testing.T, h http.Handler, method, target string) (int, []byte) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(method, target, nil))
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("%v: got content type %q", target, ct)
+	}
+	return rec.Code, rec.Body.Bytes()
+}
+
+func TestRoutes(t *testing.T) {
+	s := NewServer(&fakeQuerier{})
+	_ = s.Write(observation("node2", t0, true))
+	_ = s.Write(observation("node1", t0, true))
+	// Older and invalid observations do not replace the latest.
+	_ = s.Write(observation("node1", t0.Add(-time.Minute), true))
+	_ = s.Write(observation("node1", t0.Add(time.Minute), false))
+	h := s.Handler()
+
+	tests := []struct {
+		method string
+		target string
+		status int
+	}{
+		{http.MethodGet, "/api/stations", http.StatusOK},
+		{http.MethodGet, "/api/stations/", http.StatusOK},
+		{http.MethodHead, "/api/stations", http.StatusOK},
+		{http.MethodGet, "/api/stations/node1/current", http.StatusOK},
+		{http.MethodGet, "/api/stations/node3/current", http.StatusNotFound},
+		{http.MethodGet, "/api/stations/node1/history", http.StatusOK},
+		{http.MethodGet, "/api/stations/node1", http.StatusNotFound},
+		{http.MethodGet, "/api/stations/node1/forecast", http.StatusNotFound},
+		{http.MethodGet, "/api/gateways", http.StatusNotFound},
+		{http.MethodPost, "/api/stations", http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		status, _ := get(t, h, tt.method, tt.target)
+		if status != tt.status {
+			t.Errorf("%v %v: got %v, want %v", tt.method, tt.target, status, tt.status)
+		}
+	}
+
+	_, body := get(t, h, http.MethodGet, "/api/stations")
+	var list []Station
+	err := json.Unmarshal(body, &list)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 || list[0].ID != "node1" || list[1].ID != "node2" {
+		t.Fatalf("got stations %+v", list)
+	}
+	st := list[0]
+	if !st.LastSeen.Equal(t0) || len(st.Measurements) != 2 {
+		t.Errorf("got %+v", st)
+	}
+	want := &Radio{Counter: 7, Frequency: 868.1, DataRate: "SF7BW125", RSSI: -80, SNR: 2, Gateways: []Gateway{
+		{ID: "gw1", RSSI: -100, SNR: 2, Channel: 1},
+		{ID: "gw2", RSSI: -80, SNR: -1, Channel: 3},
+	}}
+	if !reflect.DeepEqual(st.Radio, want) {
+		t.Errorf("got radio %+v, want %+v", st.Radio, want)
+	}
+}
+
+func TestHistory(t *testing.T) {
+	rows := []sink.Row{{Time: t0, Values: map[string]float64{"temperature": 20.5}}}
+	tests := []struct {
+		name     string
+		query    string
+		status   int
+		from, to time.Time
+		fields   []string
+	}{
+		{
+			name:   "range",
+			query:  "?from=2024-05-01T00:00:00Z&to=2024-05-01T12:00:00Z",
+			status: http.StatusOK,
+			from:   t0.Add(-12 * time.Hour), to: t0,
+			fields: []string{"temperature", "temperature/2"},
+		},
+		{
+			name:   "day before to",
+			query:  "?to=2024-05-01T12:00:00Z&fields=humidity,+temperature/2,,",
+			status: http.StatusOK,
+			from:   t0.Add(-defaultHistory), to: t0,
+			fields: []string{"humidity", "temperature/2"},
+		},
+		{name: "bad from", query: "?from=yesterday", status: http.StatusBadRequest},
+		{name: "bad to", query: "?to=2024-05-01", status: http.StatusBadRequest},
+		{name: "from after to", query: "?from=2024-05-02T00:00:00Z&to=2024-05-01T00:00:00Z", status: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := &fakeQuerier{rows: rows}
+			s := NewServer(q)
+			_ = s.Write(observation("node1", t0, true))
+			status, body := get(t, s.Handler(), http.MethodGet, "/api/stations/node1/history"+tt.query)
+			if status != tt.status {
+				t.Fatalf("got %v, want %v: %s", status, tt.status, body)
+			}
+			if status != http.StatusOK {
+				if q.station != "" {
+					t.Error("queried despite bad input")
+				}
+				return
+			}
+			if q.station != "node1" || !q.from.Equal(tt.from) || !q.to.Equal(tt.to) || !reflect.DeepEqual(q.fields, tt.fields) {
+				t.Errorf("got query %v %v %v %v", q.station, q.from, q.to, q.fields)
+			}
+			var h History
+			err := json.Unmarshal(body, &h)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if h.ID != "node1" || len(h.Rows) != 1 || h.Units["temperature/2"] != "degC" {
+				t.Errorf("got %+v", h)
+			}
+		})
+	}
+}
+
+func TestHistoryDefaultFields(t *testing.T) {
+	q := &fakeQuerier{}
+	status, _ := get(t, NewServer(q).Handler(), http.MethodGet, "/api/stations/node9/history")
+	if status != http.StatusOK {
+		t.Fatalf("got %v", status)
+	}
+	want := []string{thingsif.MeasTemperature, thingsif.MeasHumidity, thingsif.MeasPressure,
+		thingsif.MeasRain, thingsif.MeasBattery}
+	if !reflect.DeepEqual(q.fields, want) {
+		t.Errorf("got fields %v, want %v", q.fields, want)
+	}
+	if d := q.to.Sub(q.from); d != defaultHistory {
+		t.Errorf("got a range of %v", d)
+	}
+}
+
+func TestHistoryBackend(t *testing.T) {
+	tests := []struct {
+		name   string
+		q      sink.Querier
+		status int
+	}{
+		{"no querier", nil, http.StatusNotImplemented},
+		{"no query backend", &sink.Fanout{}, http.StatusNotImplemented},
+		{"backend down", &fakeQuerier{err: errors.New("connection refused")}, http.StatusBadGateway},
+	}
+	for _, tt := range tests {
+		status, body := get(t, NewServer(tt.q).Handler(), http.MethodGet, "/api/stations/node1/history")
+		if status != tt.status {
+			t.Errorf("%v: got %v, want %v", tt.name, status, tt.status)
+		}
+		if !strings.Contains(string(body), `"error"`) {
+			t.Errorf("%v: got %s", tt.name, body)
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package decoder
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+const (
+	// FrameLen is the length of the frame sent by the node firmware.
+	FrameLen = 7
+	// FrameMarker terminates every firmware frame.
+	FrameMarker = 0xFE
+)
+
+/*
+ * Frame sent by the AT1284P_RFM95_DHT22 and things_uno firmware:
+ *
+ *   0-1  int16  temperature in 0.01 degC, big-endian
+ *   2-3  uint16 humidity in 0.01 %RH, big-endian
+ *   4-5  uint16 battery in mV, big-endian
+ *   6    0xFE   marker
+ */
+type Frame struct {
+	Temp  float64
+	Humid float64
+	Bat   float64
+}
+
+// DecodeFrame parses a raw firmware frame. Battery is returned in volts.
+func DecodeFrame(raw []byte) (*Frame, error) {
+	if len(raw) != FrameLen {
+		return nil, fmt.Errorf("invalid frame length: %v", len(raw))
+	}
+	if raw[FrameLen-1] != FrameMarker {
+		return nil, fmt.Errorf("invalid frame marker: %#x", raw[FrameLen-1])
+	}
+	return &Frame{
+		Temp:  float64(int16(binary.BigEndian.Uint16(raw[0:2]))) / 100,
+		Humid: float64(binary.BigEndian.Uint16(raw[2:4])) / 100,
+		Bat:   float64(binary.BigEndian.Uint16(raw[4:6])) / 1000,
+	}, nil
+}
@@ -0,0 +1,39 @@
+package decoder
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDecodeFrame(t *testing.T) {
+	tests := []struct {
+		name string
+		raw  []byte
+		want *Frame
+	}{
+		{"typical", []byte{0x07, 0xd0, 0x17, 0x70, 0x0e, 0x74, 0xfe}, &Frame{Temp: 20, Humid: 60, Bat: 3.7}},
+		{"below zero", []byte{0xfe, 0x0c, 0x27, 0x10, 0x0b, 0xb8, 0xfe}, &Frame{Temp: -5, Humid: 100, Bat: 3}},
+		{"extremes", []byte{0x80, 0x00, 0xff, 0xff, 0xff, 0xff, 0xfe}, &Frame{Temp: -327.68, Humid: 655.35, Bat: 65.535}},
+		{"short", []byte{0x07, 0xd0, 0x17, 0x70, 0x0e, 0xfe}, nil},
+		{"long", []byte{0x07, 0xd0, 0x17, 0x70, 0x0e, 0x74, 0xfe, 0xfe}, nil},
+		{"empty", nil, nil},
+		{"bad marker", []byte{0x07, 0xd0, 0x17, 0x70, 0x0e, 0x74, 0x00}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := DecodeFrame(tt.raw)
+			if tt.want == nil {
+				if err == nil {
+					t.Errorf("got %+v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,108 @@
+package decoder
+
+import (
+	"fmt"
+)
+
+// Cayenne Low Power Payload data types.
+const (
+	LPPDigitalInput  = 0
+	LPPDigitalOutput = 1
+	LPPAnalogInput   = 2
+	LPPAnalogOutput  = 3
+	LPPIlluminance   = 101
+	LPPPresence      = 102
+	LPPTemperature   = 103
+	LPPHumidity      = 104
+	LPPAccelerometer = 113
+	LPPBarometer     = 115
+	LPPGyrometer     = 134
+	LPPGPS           = 136
+)
+
+// LPPReading is a single value from a Cayenne LPP payload. Types carrying
+// several values, such as GPS, produce one reading per value.
+type LPPReading struct {
+	Channel int
+	Type    int
+	Name    string
+	Unit    string
+	Value   float64
+}
+
+type lppField struct {
+	name   string
+	unit   string
+	size   int
+	signed bool
+	scale  float64
+}
+
+var lppTypes = map[int][]lppField{
+	LPPDigitalInput:  {{"digital-input", "", 1, false, 1}},
+	LPPDigitalOutput: {{"digital-output", "", 1, false, 1}},
+	LPPAnalogInput:   {{"analog-input", "", 2, true, 100}},
+	LPPAnalogOutput:  {{"analog-output", "", 2, true, 100}},
+	LPPIlluminance:   {{"illuminance", "lx", 2, false, 1}},
+	LPPPresence:      {{"presence", "", 1, false, 1}},
+	LPPTemperature:   {{"temperature", "degC", 2, true, 10}},
+	LPPHumidity:      {{"humidity", "%RH", 1, false, 2}},
+	LPPAccelerometer: {
+		{"accelerometer-x", "g", 2, true, 1000},
+		{"accelerometer-y", "g", 2, true, 1000},
+		{"accelerometer-z", "g", 2, true, 1000},
+	},
+	LPPBarometer: {{"pressure", "hPa", 2, false, 10}},
+	LPPGyrometer: {
+		{"gyrometer-x", "deg/s", 2, true, 100},
+		{"gyrometer-y", "deg/s", 2, true, 100},
+		{"gyrometer-z", "deg/s", 2, true, 100},
+	},
+	LPPGPS: {
+		{"gps-latitude", "deg", 3, true, 10000},
+		{"gps-longitude", "deg", 3, true, 10000},
+		{"gps-altitude", "m", 3, true, 100},
+	},
+}
+
+func readInt(b []byte, signed bool) float64 {
+	var v int64
+	for i := 0; i < len(b); i++ {
+		v = v<<8 | int64(b[i])
+	}
+	if signed && b[0]&0x80 != 0 {
+		v -= 1 << (8 * uint(len(b)))
+	}
+	return float64(v)
+}
+
+// DecodeLPP parses a Cayenne LPP payload.
+func DecodeLPP(raw []byte) ([]LPPReading, error) {
+	readings := make([]LPPReading, 0)
+	for i := 0; i < len(raw); {
+		if len(raw)-i < 2 {
+			return nil, fmt.Errorf("truncated LPP header at offset %v", i)
+		}
+		channel := int(raw[i])
+		typ := int(raw[i+1])
+		i += 2
+		fields, ok := lppTypes[typ]
+		if !ok {
+			return nil, fmt.Errorf("unknown LPP type %v on channel %v", typ, channel)
+		}
+		for _, f := range fields {
+			if len(raw)-i < f.size {
+				return nil, fmt.Errorf("truncated LPP value on channel %v", channel)
+			}
+			readings = append(readings, LPPReading{
+				Channel: channel,
+				Type:    typ,
+				Name:    f.name,
+				Unit:    f.unit,
+				Value:   readInt(raw[i:i+f.size], f.signed) / f.scale,
+			})
+			i += f.size
+		}
+	}
+	return readings, nil
+}
@@ -0,0 +1,65 @@
+package decoder
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDecodeLPP(t *testing.T) {
+	tests := []struct {
+		name string
+		raw  []byte
+		want []LPPReading
+		err  bool
+	}{
+		{name: "empty", raw: nil, want: []LPPReading{}},
+		{
+			name: "temperature and humidity",
+			raw:  []byte{0x03, 0x67, 0x01, 0x10, 0x05, 0x68, 0x29},
+			want: []LPPReading{
+				{Channel: 3, Type: LPPTemperature, Name: "temperature", Unit: "degC", Value: 27.2},
+				{Channel: 5, Type: LPPHumidity, Name: "humidity", Unit: "%RH", Value: 20.5},
+			},
+		},
+		{
+			name: "negative temperature",
+			raw:  []byte{0x01, 0x67, 0xff, 0xd7},
+			want: []LPPReading{{Channel: 1, Type: LPPTemperature, Name: "temperature", Unit: "degC", Value: -4.1}},
+		},
+		{
+			name: "barometer",
+			raw:  []byte{0x02, 0x73, 0x27, 0x98},
+			want: []LPPReading{{Channel: 2, Type: LPPBarometer, Name: "pressure", Unit: "hPa", Value: 1013.6}},
+		},
+		{
+			name: "gps",
+			raw:  []byte{0x01, 0x88, 0x06, 0x76, 0x5f, 0xf2, 0x96, 0x0a, 0x00, 0x03, 0xe8},
+			want: []LPPReading{
+				{Channel: 1, Type: LPPGPS, Name: "gps-latitude", Unit: "deg", Value: 42.3519},
+				{Channel: 1, Type: LPPGPS, Name: "gps-longitude", Unit: "deg", Value: -87.9094},
+				{Channel: 1, Type: LPPGPS, Name: "gps-altitude", Unit: "m", Value: 10},
+			},
+		},
+		{name: "truncated header", raw: []byte{0x01}, err: true},
+		{name: "truncated value", raw: []byte{0x01, 0x67, 0x01}, err: true},
+		{name: "truncated gps", raw: []byte{0x01, 0x88, 0x06, 0x76, 0x5f, 0xf2}, err: true},
+		{name: "unknown type", raw: []byte{0x01, 0x99, 0x00}, err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := DecodeLPP(tt.raw)
+			if tt.err {
+				if err == nil {
+					t.Errorf("got %+v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
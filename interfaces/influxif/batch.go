@@ -0,0 +1,228 @@
+package influxif
+
+import (
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/influxdata/influxdb/client/v2"
+	"github.com/ncthompson/ThingsWeather/interfaces/metrics"
+	"github.com/ncthompson/ThingsWeather/interfaces/sink"
+)
+
+const (
+	defaultBatchPoints   = 5000
+	defaultBatchBytes    = 1 << 20
+	defaultBatchInterval = 10
+)
+
+// BatchConfig enables batched writes. A batch is flushed when it reaches
+// MaxPoints or MaxBytes of line protocol, or Interval seconds have passed.
+type BatchConfig struct {
+	MaxPoints int
+	MaxBytes  int
+	Interval  int
+}
+
+var (
+	batchFlushes = metrics.NewHistogramVec("thingsweather_influx_batch_flush_duration_seconds",
+		"Time taken to write a batch to InfluxDB.", nil, "database")
+	batchFailures = metrics.NewCounterVec("thingsweather_influx_batch_flush_failures_total",
+		"Batches InfluxDB failed to store.", "database")
+	batchPoints = metrics.NewCounterVec("thingsweather_influx_batch_points_total",
+		"Points InfluxDB stored in batches.", "database")
+)
+
+// batchStats reports the flushes of a batching writer.
+type batchStats struct {
+	Flushes     int
+	Failures    int
+	Points      int
+	LastLatency time.Duration
+	LastError   error
+}
+
+// batcher gathers points across observations and flushes them in the
+// background, so adding never waits for the database. With an ack function
+// the outcome of every flush is reported for the observations in it, and
+// a failed batch is handed back instead of kept. Without one, a batch that
+// failed for a retryable reason is kept and retried on the next flush;
+// until then new observations are refused. Rejected batches are dropped.
+type batcher struct {
+	conf     BatchConfig
+	database string
+	write    func(client.BatchPoints) error
+	create   func() (client.BatchPoints, error)
+
+	mu     sync.Mutex
+	bp     client.BatchPoints
+	obs    []*sink.Observation
+	bytes  int
+	failed bool
+	ack    func([]*sink.Observation, time.Duration, error)
+	stats  batchStats
+
+	// flushMu keeps flushes in order, it is held across the write.
+	flushMu sync.Mutex
+	kick    chan struct{}
+	done    chan struct{}
+	wg      sync.WaitGroup
+}
+
+func newBatcher(conf BatchConfig, database string, create func() (client.BatchPoints, error), write func(client.BatchPoints) error) (*batcher, error) {
+	if conf.MaxPoints <= 0 {
+		conf.MaxPoints = defaultBatchPoints
+	}
+	if conf.MaxBytes <= 0 {
+		conf.MaxBytes = defaultBatchBytes
+	}
+	if conf.Interval <= 0 {
+		conf.Interval = defaultBatchInterval
+	}
+	bp, err := create()
+	if err != nil {
+		return nil, err
+	}
+	b := &batcher{
+		conf:     conf,
+		database: database,
+		write:    write,
+		create:   create,
+		bp:       bp,
+		kick:     make(chan struct{}, 1),
+		done:     make(chan struct{}),
+	}
+	b.wg.Add(1)
+	go b.run()
+	return b, nil
+}
+
+// setAck reports the outcome of every flush to fn from now on.
+func (b *batcher) setAck(fn func([]*sink.Observation, time.Duration, error)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.ack = fn
+}
+
+func (b *batcher) run() {
+	defer b.wg.Done()
+	ticker := time.NewTicker(time.Duration(b.conf.Interval) * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			b.flush()
+		case <-b.kick:
+			b.flush()
+		case <-b.done:
+			return
+		}
+	}
+}
+
+// add queues the points of one observation and starts a flush when the
+// batch is full.
+func (b *batcher) add(points []*client.Point, obs *sink.Observation) error {
+	b.mu.Lock()
+	if b.failed {
+		err := b.stats.LastError
+		b.mu.Unlock()
+		return fmt.Errorf("batch flush failing: %v", err)
+	}
+	for _, pt := range points {
+		b.bp.AddPoint(pt)
+		b.bytes += len(pt.PrecisionString(b.bp.Precision())) + 1
+	}
+	if b.ack != nil {
+		b.obs = append(b.obs, obs)
+	}
+	full := len(b.bp.Points()) >= b.conf.MaxPoints || b.bytes >= b.conf.MaxBytes
+	b.mu.Unlock()
+	if full {
+		select {
+		case b.kick <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// flush writes the pending batch. New points are gathered in a fresh batch
+// meanwhile.
+func (b *batcher) flush() {
+	b.flushMu.Lock()
+	defer b.flushMu.Unlock()
+
+	b.mu.Lock()
+	bp, obs, size := b.bp, b.obs, b.bytes
+	n := len(bp.Points())
+	if n == 0 {
+		b.mu.Unlock()
+		return
+	}
+	next, err := b.create()
+	if err != nil {
+		b.mu.Unlock()
+		slog.Error("Batch create error", "err", err)
+		return
+	}
+	b.bp, b.obs, b.bytes = next, nil, 0
+	b.mu.Unlock()
+
+	start := time.Now()
+	err = b.write(bp)
+	latency := time.Since(start)
+	batchFlushes.Observe(latency.Seconds(), b.database)
+	if err != nil {
+		batchFailures.Inc(b.database)
+	} else {
+		batchPoints.Add(float64(n), b.database)
+	}
+
+	b.mu.Lock()
+	b.stats.LastLatency = latency
+	b.stats.Flushes++
+	b.stats.LastError = err
+	ack := b.ack
+	b.failed = false
+	switch {
+	case err == nil:
+		b.stats.Points += n
+	case ack == nil && !sink.IsPermanent(err):
+		// Keep the batch ahead of the points added since.
+		b.stats.Failures++
+		b.failed = true
+		for _, pt := range b.bp.Points() {
+			bp.AddPoint(pt)
+		}
+		b.bp = bp
+		b.bytes += size
+	default:
+		b.stats.Failures++
+	}
+	b.mu.Unlock()
+
+	if err != nil {
+		slog.Error("Batch flush failed", "points", n, "latency", latency, "permanent", sink.IsPermanent(err), "err", err)
+	}
+	if ack != nil {
+		ack(obs, latency, err)
+	}
+}
+
+func (b *batcher) Stats() batchStats {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.stats
+}
+
+// close stops the background flush and flushes what is pending.
+func (b *batcher) close() {
+	close(b.done)
+	b.wg.Wait()
+	b.flush()
+	s := b.Stats()
+	slog.Info("Batch writer closed", "points", s.Points, "flushes", s.Flushes, "failures", s.Failures,
+		"latency", s.LastLatency)
+}
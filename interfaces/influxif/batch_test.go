@@ -0,0 +1,252 @@
+package influxif
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/influxdata/influxdb/client/v2"
+	"github.com/ncthompson/ThingsWeather/interfaces/metrics"
+	"github.com/ncthompson/ThingsWeather/interfaces/sink"
+)
+
+// fakeWriter records the batches written and fails with err while set.
+type fakeWriter struct {
+	mu      sync.Mutex
+	err     error
+	batches []int
+	block   chan struct{}
+}
+
+func (w *fakeWriter) write(bp client.BatchPoints) error {
+	if w.block != nil {
+		<-w.block
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err != nil {
+		return w.err
+	}
+	w.batches = append(w.batches, len(bp.Points()))
+	return nil
+}
+
+func (w *fakeWriter) setErr(err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.err = err
+}
+
+func (w *fakeWriter) written() []int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return append([]int{}, w.batches...)
+}
+
+func newTestBatcher(t *testing.T, conf BatchConfig, w *fakeWriter) *batcher {
+	t.Helper()
+	return newNamedBatcher(t, "test", conf, w)
+}
+
+func newNamedBatcher(t *testing.T, database string, conf BatchConfig, w *fakeWriter) *batcher {
+	t.Helper()
+	if conf.Interval == 0 {
+		conf.Interval = 3600
+	}
+	b, err := newBatcher(conf, database, func() (client.BatchPoints, error) {
+		return client.NewBatchPoints(client.BatchPointsConfig{Database: "test"})
+	}, w.write)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func testPoints(n int) []*client.Point {
+	points := make([]*client.Point, n)
+	for i := range points {
+		points[i], _ = client.NewPoint("temperature", map[string]string{"device-id": "node1"},
+			map[string]interface{}{"value": float64(i)}, time.Unix(int64(i), 0))
+	}
+	return points
+}
+
+func TestBatcherFlushWhenFull(t *testing.T) {
+	w := &fakeWriter{}
+	b := newTestBatcher(t, BatchConfig{MaxPoints: 4}, w)
+	defer b.close()
+	for i := 0; i < 2; i++ {
+		err := b.add(testPoints(2), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(w.written()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("full batch not flushed")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if got := w.written(); len(got) != 1 || got[0] != 4 {
+		t.Errorf("got batches %v, want [4]", got)
+	}
+}
+
+func TestBatcherFlushOnClose(t *testing.T) {
+	w := &fakeWriter{}
+	b := newTestBatcher(t, BatchConfig{}, w)
+	err := b.add(testPoints(3), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.close()
+	if got := w.written(); len(got) != 1 || got[0] != 3 {
+		t.Errorf("got batches %v, want [3]", got)
+	}
+	if s := b.Stats(); s.Flushes != 1 || s.Points != 3 || s.Failures != 0 {
+		t.Errorf("got stats %+v", s)
+	}
+}
+
+func TestBatcherRetryWithoutAck(t *testing.T) {
+	w := &fakeWriter{err: errors.New("timeout")}
+	b := newTestBatcher(t, BatchConfig{}, w)
+	defer b.close()
+	err := b.add(testPoints(2), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.flush()
+	if b.add(testPoints(1), nil) == nil {
+		t.Error("add accepted while the flush is failing")
+	}
+	w.setErr(nil)
+	b.flush()
+	if got := w.written(); len(got) != 1 || got[0] != 2 {
+		t.Errorf("got batches %v, want the retried [2]", got)
+	}
+	if b.add(testPoints(1), nil) != nil {
+		t.Error("add refused after a successful flush")
+	}
+}
+
+func TestBatcherPermanentWithoutAck(t *testing.T) {
+	w := &fakeWriter{err: sink.Permanent(errors.New("field type conflict"))}
+	b := newTestBatcher(t, BatchConfig{}, w)
+	defer b.close()
+	err := b.add(testPoints(2), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.flush()
+	if b.add(testPoints(1), nil) != nil {
+		t.Error("add refused after a rejected batch")
+	}
+	w.setErr(nil)
+	b.flush()
+	if got := w.written(); len(got) != 1 || got[0] != 1 {
+		t.Errorf("got batches %v, want the rejected batch dropped", got)
+	}
+	if s := b.Stats(); s.Failures != 1 || s.Flushes != 2 {
+		t.Errorf("got stats %+v", s)
+	}
+}
+
+func TestBatcherAck(t *testing.T) {
+	w := &fakeWriter{}
+	b := newTestBatcher(t, BatchConfig{}, w)
+	defer b.close()
+	var mu sync.Mutex
+	acked := make(map[string]error)
+	b.setAck(func(list []*sink.Observation, _ time.Duration, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, o := range list {
+			acked[o.Station] = err
+		}
+	})
+
+	_ = b.add(testPoints(1), &sink.Observation{Station: "a"})
+	b.flush()
+	failure := errors.New("timeout")
+	w.setErr(failure)
+	_ = b.add(testPoints(1), &sink.Observation{Station: "b"})
+	b.flush()
+	// With an ack the failed batch is handed back, not retried.
+	err := b.add(testPoints(1), &sink.Observation{Station: "c"})
+	if err != nil {
+		t.Errorf("add refused: %v", err)
+	}
+	w.setErr(nil)
+	b.flush()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(acked) != 3 || acked["a"] != nil || acked["b"] != failure || acked["c"] != nil {
+		t.Errorf("got acks %v", acked)
+	}
+	if got := w.written(); len(got) != 2 {
+		t.Errorf("got batches %v, want 2", got)
+	}
+}
+
+func TestBatcherAddDuringSlowWrite(t *testing.T) {
+	w := &fakeWriter{block: make(chan struct{})}
+	b := newTestBatcher(t, BatchConfig{}, w)
+	_ = b.add(testPoints(1), nil)
+	flushed := make(chan struct{})
+	go func() {
+		b.flush()
+		close(flushed)
+	}()
+	added := make(chan error)
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		added <- b.add(testPoints(1), nil)
+	}()
+	select {
+	case err := <-added:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("add blocked behind the write")
+	}
+	close(w.block)
+	<-flushed
+	b.close()
+	if got := w.written(); len(got) != 2 || got[0] != 1 || got[1] != 1 {
+		t.Errorf("got batches %v, want [1 1]", got)
+	}
+}
+
+func TestBatcherMetrics(t *testing.T) {
+	w := &fakeWriter{}
+	b := newNamedBatcher(t, "metrics", BatchConfig{}, w)
+	_ = b.add(testPoints(3), nil)
+	b.flush()
+	w.setErr(errors.New("timeout"))
+	_ = b.add(testPoints(2), nil)
+	b.flush()
+	w.setErr(nil)
+	b.close()
+
+	var buf bytes.Buffer
+	err := metrics.Default.WriteText(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		`thingsweather_influx_batch_flush_duration_seconds_count{database="metrics"} 3`,
+		`thingsweather_influx_batch_flush_failures_total{database="metrics"} 1`,
+		`thingsweather_influx_batch_points_total{database="metrics"} 5`,
+	} {
+		if !strings.Contains(buf.String(), want+"\n") {
+			t.Errorf("missing %v", want)
+		}
+	}
+}
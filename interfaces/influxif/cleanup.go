@@ -0,0 +1,164 @@
+package influxif
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+
+	"github.com/influxdata/influxdb/client/v2"
+	"github.com/ncthompson/ThingsWeather/interfaces/thingsif"
+)
+
+// phantomMeasurements were written as zero for every node, whether or
+// not the node has the sensor.
+var phantomMeasurements = []string{thingsif.MeasRain, thingsif.MeasPressure}
+
+func toFloat(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case json.Number:
+		f, err := n.Float64()
+		return f, err == nil
+	case float64:
+		return n, true
+	}
+	return 0, false
+}
+
+func toInt(v interface{}) (int64, bool) {
+	n, ok := v.(json.Number)
+	if !ok {
+		return 0, false
+	}
+	i, err := n.Int64()
+	return i, err == nil
+}
+
+func (inf *InfluxIf) query(command string) ([]client.Result, error) {
+	response, err := inf.cli.Query(client.NewQuery(command, inf.conf.Database, precision))
+	if err != nil {
+		return nil, err
+	}
+	if response.Error() != nil {
+		return nil, response.Error()
+	}
+	return response.Results, nil
+}
+
+// DeletePhantomZeros removes the zero rain and pressure values written for
+// nodes without those sensors. Devices that only ever reported zero lose
+// the whole series, zero pressure points are removed from all devices as
+// 0 hPa is not a real reading. It returns the number of series and points
+// deleted per measurement, or that would be deleted when dryRun is set.
+func (inf *InfluxIf) DeletePhantomZeros(dryRun bool) (map[string]int, error) {
+	deleted := make(map[string]int)
+	if inf.v2 != nil {
+		return deleted, errors.New("phantom zero cleanup needs InfluxQL delete, only available on InfluxDB 1.x")
+	}
+	for _, name := range phantomMeasurements {
+		results, err := inf.query(fmt.Sprintf(`select max("value"), min("value") from %q group by "device-id";`, name))
+		if err != nil {
+			return deleted, err
+		}
+		for _, row := range results[0].Series {
+			if len(row.Values) == 0 || len(row.Values[0]) < 3 {
+				continue
+			}
+			hi, okHi := toFloat(row.Values[0][1])
+			lo, okLo := toFloat(row.Values[0][2])
+			dev := row.Tags["device-id"]
+			if okHi && okLo && hi == 0 && lo == 0 {
+				slog.Info("All zero", "measurement", name, "device", dev)
+				deleted[name]++
+				if !dryRun {
+					_, err = inf.query(fmt.Sprintf(`delete from %q where "device-id" = %v;`, name, quoteString(dev)))
+					if err != nil {
+						return deleted, err
+					}
+				}
+				continue
+			}
+			if name != thingsif.MeasPressure {
+				continue
+			}
+			n, err := inf.deleteZeroPoints(name, dev, dryRun)
+			deleted[name] += n
+			if err != nil {
+				return deleted, err
+			}
+		}
+	}
+	return deleted, nil
+}
+
+// seriesWhere matches exactly the series with tags. Tags a series does
+// not have are returned empty and match only series without them.
+func seriesWhere(tags map[string]string) string {
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	conds := make([]string, len(keys))
+	for i, k := range keys {
+		conds[i] = fmt.Sprintf("%q = %v", k, quoteString(tags[k]))
+	}
+	return strings.Join(conds, " and ")
+}
+
+// deleteZeroPoints removes the zero points of a device, series by series so
+// readings of its other sensors are kept. Consecutive zeros of a series
+// are deleted as one time range, so a node that reported zero for weeks
+// costs a single delete rather than one per point.
+func (inf *InfluxIf) deleteZeroPoints(name, dev string, dryRun bool) (int, error) {
+	results, err := inf.query(fmt.Sprintf(`select "value" from %q where "device-id" = %v group by *;`, name, quoteString(dev)))
+	if err != nil {
+		return 0, err
+	}
+	deleted := 0
+	for _, row := range results[0].Series {
+		where := seriesWhere(row.Tags)
+		var run []int64
+		end := func() error {
+			if len(run) == 0 {
+				return nil
+			}
+			first, last := run[0], run[len(run)-1]
+			n := len(run)
+			run = run[:0]
+			slog.Info("Zero run", "measurement", name, "series", where, "from", first, "to", last, "points", n)
+			deleted += n
+			if dryRun {
+				return nil
+			}
+			_, err := inf.query(fmt.Sprintf(`delete from %q where %v and time >= %v and time <= %v;`,
+				name, where, first, last))
+			return err
+		}
+		for _, v := range row.Values {
+			if len(v) < 2 {
+				continue
+			}
+			ts, ok := toInt(v[0])
+			if !ok {
+				continue
+			}
+			f, ok := toFloat(v[1])
+			if ok && f == 0 {
+				run = append(run, ts)
+				continue
+			}
+			err = end()
+			if err != nil {
+				return deleted, err
+			}
+		}
+		err = end()
+		if err != nil {
+			return deleted, err
+		}
+	}
+	return deleted, nil
+}
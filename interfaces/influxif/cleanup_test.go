@@ -0,0 +1,110 @@
+package influxif
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/influxdata/influxdb/client/v2"
+	"github.com/influxdata/influxdb/models"
+)
+
+// fakeBackend answers queries from a map and records the statements
+// that change data and the points written.
+type fakeBackend struct {
+	results map[string][]models.Row
+	deletes []string
+	into    []string
+	written []string
+}
+
+func (b *fakeBackend) Write(bp client.BatchPoints) error {
+	for _, pt := range bp.Points() {
+		b.written = append(b.written, pt.String())
+	}
+	return nil
+}
+
+func (b *fakeBackend) Query(q client.Query) (*client.Response, error) {
+	switch {
+	case strings.HasPrefix(q.Command, "delete"):
+		b.deletes = append(b.deletes, q.Command)
+		return &client.Response{Results: []client.Result{{}}}, nil
+	case strings.Contains(q.Command, " into "):
+		b.into = append(b.into, q.Command)
+		return &client.Response{Results: []client.Result{{}}}, nil
+	}
+	return &client.Response{Results: []client.Result{{Series: b.results[q.Command]}}}, nil
+}
+
+func (b *fakeBackend) Close() error {
+	return nil
+}
+
+// point is a time and value row as returned by the client.
+func point(ts, v string) []interface{} {
+	return []interface{}{json.Number(ts), json.Number(v)}
+}
+
+func TestDeletePhantomZeros(t *testing.T) {
+	extremes := func(dev, hi, lo string) models.Row {
+		return models.Row{Tags: map[string]string{"device-id": dev},
+			Values: [][]interface{}{{json.Number("0"), json.Number(hi), json.Number(lo)}}}
+	}
+	b := &fakeBackend{results: map[string][]models.Row{
+		`select max("value"), min("value") from "rain-tips" group by "device-id";`: {
+			extremes("node1", "0", "0"),
+			extremes("node2", "1.5", "0"),
+		},
+		`select max("value"), min("value") from "pressure" group by "device-id";`: {
+			extremes("o'brien", "0", "0"),
+			extremes("node2", "1013", "0"),
+		},
+		`select "value" from "pressure" where "device-id" = 'node2' group by *;`: {{
+			Tags: map[string]string{"device-id": "node2", "port": "1", "sensor-channel": ""},
+			Values: [][]interface{}{
+				point("1", "0"), point("2", "0"), point("3", "0"),
+				point("4", "1013"),
+				point("5", "0"),
+				point("6", "1012"), point("7", "1011"),
+				point("8", "0"), point("9", "0"),
+			},
+		}, {
+			// A second sensor of the device, only real readings.
+			Tags: map[string]string{"device-id": "node2", "port": "1", "sensor-channel": "2"},
+			Values: [][]interface{}{
+				point("1", "1013.5"), point("2", "1013.4"), point("5", "1013.2"), point("8", "1013"),
+			},
+		}},
+	}}
+
+	for _, dryRun := range []bool{true, false} {
+		b.deletes = nil
+		inf := &InfluxIf{cli: b}
+		got, err := inf.DeletePhantomZeros(dryRun)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := map[string]int{"rain-tips": 1, "pressure": 7}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("dry run %v: got %v, want %v", dryRun, got, want)
+		}
+		if dryRun {
+			if len(b.deletes) != 0 {
+				t.Errorf("dry run deleted %v", b.deletes)
+			}
+			continue
+		}
+		wantDeletes := []string{
+			`delete from "rain-tips" where "device-id" = 'node1';`,
+			`delete from "pressure" where "device-id" = 'o\'brien';`,
+			`delete from "pressure" where "device-id" = 'node2' and "port" = '1' and "sensor-channel" = '' and time >= 1 and time <= 3;`,
+			`delete from "pressure" where "device-id" = 'node2' and "port" = '1' and "sensor-channel" = '' and time >= 5 and time <= 5;`,
+			`delete from "pressure" where "device-id" = 'node2' and "port" = '1' and "sensor-channel" = '' and time >= 8 and time <= 9;`,
+		}
+		if !reflect.DeepEqual(b.deletes, wantDeletes) {
+			t.Errorf("got deletes\n%v\nwant\n%v", strings.Join(b.deletes, "\n"), strings.Join(wantDeletes, "\n"))
+		}
+	}
+}
@@ -1,13 +1,15 @@
 package influxif
 
 import (
+	"encoding/json"
 	"fmt"
-	"log"
+	"log/slog"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/influxdata/influxdb/client/v2"
-	"github.com/ncthompson/ThingsWeather/interfaces/stbsource"
+	"github.com/ncthompson/ThingsWeather/interfaces/sink"
 	"github.com/ncthompson/ThingsWeather/interfaces/thingsif"
 )
 
@@ -15,27 +17,144 @@ const precision = "ns"
 
 type InfluxConfig struct {
 	HostAddress string
-	Database    string
-	Username    string
-	Password    string
+	// Version selects the API: 1 (default) for InfluxDB 1.x with a
+	// database and username/password, 2 for the token based API of
+	// InfluxDB 2.x and 3.x with an organisation and bucket.
+	Version  int
+	Database string
+	Username string
+	Password string
+	Token    string
+	Org      string
+	Bucket   string
+	// Precision of written timestamps: ns (default), us, ms or s.
+	Precision string
+	// Gzip compresses writes on version 2.
+	Gzip bool
+	// QueryLanguage used for reads on version 2: influxql (default),
+	// through the 1.x compatibility endpoint, or flux.
+	QueryLanguage string
+	// Schema of written points, SchemaLegacy (default) or SchemaWide.
+	Schema string
+	// Batch gathers points across observations when set, otherwise
+	// every observation is written on its own.
+	Batch *BatchConfig
+}
+
+// LogValue keeps the password and token out of logs.
+func (c InfluxConfig) LogValue() slog.Value {
+	type plain InfluxConfig
+	if c.Password != "" {
+		c.Password = "REDACTED"
+	}
+	if c.Token != "" {
+		c.Token = "REDACTED"
+	}
+	return slog.AnyValue(plain(c))
 }
 
 type InfluxIf struct {
-	conf InfluxConfig
-	cli  client.Client
+	conf  InfluxConfig
+	cli   backend
+	v2    *v2Client
+	batch *batcher
+}
+
+func init() {
+	sink.Register("influx", func(raw json.RawMessage) (sink.Sink, error) {
+		conf := InfluxConfig{}
+		err := json.Unmarshal(raw, &conf)
+		if err != nil {
+			return nil, err
+		}
+		return NewClient(conf)
+	})
 }
 
 func NewClient(conf InfluxConfig) (*InfluxIf, error) {
 	inf := &InfluxIf{}
 	inf.conf = conf
-	idb, err := client.NewHTTPClient(client.HTTPConfig{
-		Addr:     conf.HostAddress,
-		Username: conf.Username,
-		Password: conf.Password,
-	})
-	inf.cli = idb
+	switch conf.Precision {
+	case "", "ns", "us", "ms", "s":
+	default:
+		return nil, fmt.Errorf("unknown precision: %v", conf.Precision)
+	}
+	switch conf.Schema {
+	case "", SchemaLegacy, SchemaWide:
+	default:
+		return nil, fmt.Errorf("unknown schema: %v", conf.Schema)
+	}
+	switch conf.Version {
+	case 0, 1:
+		idb, err := client.NewHTTPClient(client.HTTPConfig{
+			Addr:     conf.HostAddress,
+			Username: conf.Username,
+			Password: conf.Password,
+		})
+		if err != nil {
+			return nil, err
+		}
+		inf.cli = idb
+	case 2:
+		v2, err := newV2Client(conf)
+		if err != nil {
+			return nil, err
+		}
+		inf.cli = v2
+		inf.v2 = v2
+		inf.conf.Database = conf.Bucket
+	default:
+		return nil, fmt.Errorf("unknown InfluxDB version: %v", conf.Version)
+	}
+	if conf.Batch != nil {
+		b, err := newBatcher(*conf.Batch, inf.conf.Database, inf.newBatch, inf.write)
+		if err != nil {
+			return nil, err
+		}
+		inf.batch = b
+	}
+	return inf, nil
+}
+
+// Acknowledge reports the outcome of batched writes to fn, as Write only
+// queues their points. Without batching Write stores synchronously and
+// Acknowledge returns false.
+func (inf *InfluxIf) Acknowledge(fn func([]*sink.Observation, time.Duration, error)) bool {
+	if inf.batch == nil {
+		return false
+	}
+	inf.batch.setAck(fn)
+	return true
+}
+
+func (inf *InfluxIf) writePrecision() string {
+	if inf.conf.Precision == "" {
+		return precision
+	}
+	return inf.conf.Precision
+}
+
+func (inf *InfluxIf) wide() bool {
+	return inf.conf.Schema == SchemaWide
+}
+
+// payloadMeasurement is the measurement every stored payload has a point in.
+func (inf *InfluxIf) payloadMeasurement() string {
+	if inf.wide() {
+		return measWeather
+	}
+	return thingsif.MeasTemperature
+}
+
+func (inf *InfluxIf) setPayload(p *thingsif.Payload, t time.Time, tags map[string]string, bp client.BatchPoints) error {
+	if inf.wide() {
+		return setWeather(p, t, tags, bp)
+	}
+	return setPayload(p, t, tags, bp)
+}
 
-	return inf, err
+func (inf *InfluxIf) useFlux() bool {
+	return inf.v2 != nil && inf.conf.QueryLanguage == queryFlux
 }
 
 func addDataPoint(name string, value float64, ts time.Time, tags map[string]string, bp client.BatchPoints) error {
@@ -56,139 +175,115 @@ func addDataPoint(name string, value float64, ts time.Time, tags map[string]stri
 	return nil
 }
 
-func (inf *InfluxIf) dataToBatch(data *thingsif.Message) (client.BatchPoints, error) {
-
-	timeStamp, err := time.Parse(time.RFC3339Nano, data.Metadata.Time)
-	if err != nil {
-		return nil, err
-	}
-
-	bp, err := client.NewBatchPoints(client.BatchPointsConfig{
+func (inf *InfluxIf) newBatch() (client.BatchPoints, error) {
+	return client.NewBatchPoints(client.BatchPointsConfig{
 		Database:  inf.conf.Database,
-		Precision: precision,
+		Precision: inf.writePrecision(),
 	})
-	if err != nil {
-		return bp, err
-	}
+}
 
+// deviceTags are the tags identifying the device of an uplink.
+func deviceTags(data *thingsif.Uplink) map[string]string {
 	tags := map[string]string{
 		"device-id":       data.DevID,
 		"hardware-serial": data.HWSerial,
-		"port":            strconv.Itoa(data.Port),
 	}
-	payload := data.PayloadFields
-	meta := data.Metadata
-	if payload.Valid {
-		err = setPayload(payload, timeStamp, tags, bp)
+	// Port 0 carries no application data, it marks a history row whose
+	// port is unknown.
+	if data.Port != 0 {
+		tags["port"] = strconv.Itoa(data.Port)
+	}
+	return tags
+}
+
+func (inf *InfluxIf) setUplink(data *thingsif.Uplink, payload *thingsif.Payload, bp client.BatchPoints) error {
+	timeStamp := data.Time
+	tags := deviceTags(data)
+	if payload != nil && payload.Valid {
+		err := inf.setPayload(payload, timeStamp, tags, bp)
 		if err != nil {
-			return bp, err
+			return err
+		}
+	}
+	if data.Frequency == 0 && len(data.Gateways) == 0 {
+		// No radio metadata, as for history rows.
+		return nil
+	}
+	tags["modulation"] = data.Modulation
+	tags["data_rate"] = data.DataRate
+	tags["coding_rate"] = data.CodingRate
+
+	if inf.wide() {
+		for i := 0; i < len(data.Gateways); i++ {
+			err := setRadio(data.Gateways[i], data.Frequency, timeStamp, tags, bp)
+			if err != nil {
+				return err
+			}
 		}
+		return nil
 	}
-	tags["modulation"] = meta.Modulation
-	tags["data_rate"] = meta.DataRate
-	tags["coding_rate"] = meta.CodingRate
 
-	err = addDataPoint("frequency", meta.Frequency, timeStamp, tags, bp)
+	err := addDataPoint("frequency", data.Frequency, timeStamp, tags, bp)
 	if err != nil {
-		return bp, err
+		return err
 	}
 
-	for i := 0; i < len(meta.Gateways); i++ {
-		gw := meta.Gateways[i]
-		err = setGateway(gw, meta.Frequency, timeStamp, tags, bp)
+	for i := 0; i < len(data.Gateways); i++ {
+		gw := data.Gateways[i]
+		err = setGateway(gw, data.Frequency, timeStamp, tags, bp)
 		if err != nil {
-			return bp, err
+			return err
 		}
 	}
-
-	return bp, nil
+	return nil
 }
 
-func (inf *InfluxIf) stbDataToBatch(data *stbsource.StbWeather) (client.BatchPoints, error) {
-	bp, err := client.NewBatchPoints(client.BatchPointsConfig{
-		Database:  inf.conf.Database,
-		Precision: precision,
-	})
+func (inf *InfluxIf) obsToBatch(obs *sink.Observation) (client.BatchPoints, error) {
+	bp, err := inf.newBatch()
 	if err != nil {
 		return bp, err
 	}
-	tags := map[string]string{
-		"device-id": data.Station,
-	}
-
-	err = addDataPoint("temperature", data.Temperature, data.Timestamp.UTC(), tags, bp)
-	if err != nil {
+	if obs.Uplink != nil {
+		err = inf.setUplink(obs.Uplink, obs.Payload, bp)
+		if err == nil && obs.Link != nil {
+			err = inf.setLink(obs.Link, obs.Uplink.Time, deviceTags(obs.Uplink), bp)
+		}
 		return bp, err
 	}
-
-	err = addDataPoint("humidity", data.Humidity, data.Timestamp.UTC(), tags, bp)
-	if err != nil {
-		return bp, err
+	tags := map[string]string{
+		"device-id": obs.Station,
 	}
-	return bp, nil
-}
-
-func (inf *InfluxIf) WriteStbToDatabase(data *stbsource.StbWeather) error {
-	batch, err := inf.stbDataToBatch(data)
-	if err != nil {
-		return err
+	if obs.Payload != nil && obs.Payload.Valid {
+		err = inf.setPayload(obs.Payload, obs.Time.UTC(), tags, bp)
 	}
-	return inf.cli.Write(batch)
+	return bp, err
 }
 
-func (inf *InfluxIf) WriteToDatabase(data *thingsif.Message) error {
-	batch, err := inf.dataToBatch(data)
+// Write stores an observation and the radio metadata of its uplink.
+// Observations that cannot be stored at all fail with a permanent error.
+func (inf *InfluxIf) Write(obs *sink.Observation) error {
+	batch, err := inf.obsToBatch(obs)
 	if err != nil {
-		return err
+		return sink.Permanent(err)
+	}
+	if inf.batch != nil {
+		return inf.batch.add(batch.Points(), obs)
 	}
-	return inf.cli.Write(batch)
+	return inf.write(batch)
 }
 
-func (inf *InfluxIf) SyncDatabase(data []thingsif.DbMessage) error {
-
-	log.Printf("Entries: %v\n", len(data))
-	added := 0
-	bp, err := client.NewBatchPoints(client.BatchPointsConfig{
-		Database:  inf.conf.Database,
-		Precision: precision,
-	})
-	if err != nil {
+// write sends a batch. Points the 1.x server refuses to parse or store
+// fail with a permanent error, version 2 classifies by status code.
+func (inf *InfluxIf) write(bp client.BatchPoints) error {
+	err := inf.cli.Write(bp)
+	if err == nil || inf.v2 != nil {
 		return err
 	}
-	for i := 0; i < len(data); i++ {
-		ts, err := time.Parse(time.RFC3339Nano, data[i].Time)
-		if err != nil {
-			return err
-		}
-		// Assume all point will be logged together.
-		query := fmt.Sprintf("select * from temperature where time=%v;", ts.UnixNano())
-		q := client.NewQuery(query, inf.conf.Database, precision)
-
-		response, err := inf.cli.Query(q)
-		if err != nil {
-			log.Println(err.Error())
-			return err
-
-		}
-		if len(response.Results[0].Series) == 0 {
-			payload := data[i]
-			if payload.Valid {
-				added++
-				tags := map[string]string{
-					"device-id": data[i].DevID,
-				}
-				err = setPayload(payload.NodeEntry(), ts, tags, bp)
-				if err != nil {
-					return err
-				}
-			}
-		}
+	msg := err.Error()
+	if strings.Contains(msg, "partial write") || strings.Contains(msg, "unable to parse") {
+		return sink.Permanent(err)
 	}
-	log.Printf("Points synced: %v\n", added)
-	if len(bp.Points()) > 0 {
-		return inf.cli.Write(bp)
-	}
-	return nil
+	return err
 }
 
 func setGateway(g *thingsif.GwMetadata, freq float64, t time.Time, tags map[string]string, bp client.BatchPoints) error {
@@ -219,30 +314,35 @@ func setGateway(g *thingsif.GwMetadata, freq float64, t time.Time, tags map[stri
 	return nil
 }
 
-func setPayload(p *thingsif.NodeEntry, t time.Time, tags map[string]string, bp client.BatchPoints) error {
-	err := addDataPoint("temperature", p.Temp, t, tags, bp)
-	if err != nil {
-		return err
-	}
-	err = addDataPoint("humidity", p.Humid, t, tags, bp)
-	if err != nil {
-		return err
-	}
-	err = addDataPoint("battery-voltage", p.Bat, t, tags, bp)
-	if err != nil {
-		return err
-	}
-	err = addDataPoint("rain-tips", p.Rain, t, tags, bp)
-	if err != nil {
-		return err
-	}
-	err = addDataPoint("pressure", p.Pres, t, tags, bp)
-	if err != nil {
-		return err
+// setPayload writes a point with only a value field per measurement, as
+// dashboards of the legacy schema expect. Units and quality flags are left
+// to the wide schema.
+func setPayload(p *thingsif.Payload, t time.Time, tags map[string]string, bp client.BatchPoints) error {
+	for i := 0; i < len(p.Measurements); i++ {
+		m := p.Measurements[i]
+		field := map[string]interface{}{
+			"value": m.Value,
+		}
+		tagsM := tags
+		if m.Channel != "" {
+			tagsM = make(map[string]string, len(tags)+1)
+			for k, v := range tags {
+				tagsM[k] = v
+			}
+			tagsM["sensor-channel"] = m.Channel
+		}
+		pt, err := client.NewPoint(m.Name, tagsM, field, t)
+		if err != nil {
+			return err
+		}
+		bp.AddPoint(pt)
 	}
 	return nil
 }
 
 func (inf *InfluxIf) Close() {
+	if inf.batch != nil {
+		inf.batch.close()
+	}
 	inf.cli.Close()
 }
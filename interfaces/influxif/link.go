@@ -0,0 +1,74 @@
+package influxif
+
+import (
+	"time"
+
+	"github.com/influxdata/influxdb/client/v2"
+	"github.com/ncthompson/ThingsWeather/interfaces/thingsif"
+)
+
+const (
+	// measLoss holds the packet loss of one window in the legacy schema.
+	measLoss = "packet-loss"
+	// measLink holds the packet loss of all windows in the wide schema.
+	measLink = "link"
+	// measGap holds a range of missed frame counters.
+	measGap = "frame-gap"
+)
+
+// setLink writes the packet loss after an uplink and the frame counter
+// gaps it revealed.
+func (inf *InfluxIf) setLink(link *thingsif.LinkStats, t time.Time, tags map[string]string, bp client.BatchPoints) error {
+	if inf.wide() {
+		fields := make(map[string]interface{}, 3*len(link.Windows)+1)
+		fields["epoch"] = link.Epoch
+		for _, w := range link.Windows {
+			fields["loss-"+w.Window] = w.Loss
+			fields["received-"+w.Window] = w.Received
+			fields["missed-"+w.Window] = w.Missed
+		}
+		err := addPoint(measLink, tags, fields, t, bp)
+		if err != nil {
+			return err
+		}
+	} else {
+		for _, w := range link.Windows {
+			tagsW := make(map[string]string, len(tags)+1)
+			for k, v := range tags {
+				tagsW[k] = v
+			}
+			tagsW["window"] = w.Window
+			fields := map[string]interface{}{
+				"value":    w.Loss,
+				"received": w.Received,
+				"missed":   w.Missed,
+			}
+			err := addPoint(measLoss, tagsW, fields, t, bp)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	for _, g := range link.Gaps {
+		fields := map[string]interface{}{
+			"first":  g.First,
+			"last":   g.Last,
+			"missed": g.Missed(),
+			"epoch":  g.Epoch,
+		}
+		err := addPoint(measGap, tags, fields, g.Time, bp)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func addPoint(name string, tags map[string]string, fields map[string]interface{}, t time.Time, bp client.BatchPoints) error {
+	pt, err := client.NewPoint(name, tags, fields, t)
+	if err != nil {
+		return err
+	}
+	bp.AddPoint(pt)
+	return nil
+}
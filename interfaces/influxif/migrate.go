@@ -0,0 +1,251 @@
+package influxif
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"time"
+
+	"github.com/influxdata/influxdb/client/v2"
+)
+
+// radioMeasurements are the per gateway measurements of the legacy schema.
+var radioMeasurements = map[string]bool{
+	"rssi":      true,
+	"snr":       true,
+	"altitude":  true,
+	"latitude":  true,
+	"longitude": true,
+}
+
+// weatherGroup and radioGroup are the tags kept on migrated points; they
+// match the tags written by the legacy schema so the values of one uplink
+// merge into a single point. The frequency tag of the legacy gateway points
+// is dropped, the radio points carry the frequency as a field.
+const (
+	weatherGroup = `"device-id", "hardware-serial", "port"`
+	radioGroup   = `"device-id", "hardware-serial", "port", "modulation", "data_rate", "coding_rate", "gtw_id", "channel"`
+)
+
+const (
+	// migrateChunk is the time range copied per statement, so a large
+	// database is not read in one go.
+	migrateChunk = 7 * 24 * time.Hour
+	// migrateBatch is the number of points written at once when the
+	// client copies points itself.
+	migrateBatch = 5000
+)
+
+// migration copies one legacy measurement. Query selects from it with a
+// %v for the time range of a chunk. Without into, the client writes the
+// rows as radio points itself: a tag can only be selected into a string
+// field, while live radio points carry the frequency as a float.
+type migration struct {
+	from  string
+	query string
+	into  bool
+}
+
+func (inf *InfluxIf) listColumn(command string) ([]string, error) {
+	results, err := inf.query(command)
+	if err != nil {
+		return nil, err
+	}
+	values := make([]string, 0)
+	for _, row := range results[0].Series {
+		for _, v := range row.Values {
+			// Tag value listings return key and value, measurements only
+			// the name.
+			if s, ok := v[len(v)-1].(string); ok {
+				values = append(values, s)
+			}
+		}
+	}
+	return values, nil
+}
+
+// migrations lists what copies the legacy measurements into the weather
+// and radio measurements.
+func (inf *InfluxIf) migrations() ([]migration, error) {
+	names, err := inf.listColumn("show measurements;")
+	if err != nil {
+		return nil, err
+	}
+	list := make([]migration, 0)
+	for _, name := range names {
+		switch {
+		case name == measWeather || name == measRadio:
+			continue
+		case name == "frequency":
+			// The same frequency is a tag of the rssi points, which join
+			// it onto each gateway.
+			continue
+		case name == measLoss || name == measLink || name == measGap:
+			// Packet loss statistics are not weather data.
+			continue
+		case name == "rssi":
+			list = append(list, migration{from: name,
+				query: fmt.Sprintf(`select "value", "frequency" from %q where %%v group by %v;`, name, radioGroup)})
+			continue
+		case radioMeasurements[name]:
+			list = append(list, migration{from: name, into: true,
+				query: fmt.Sprintf(`select "value" as %q into %q from %q where %%v group by %v;`,
+					name, measRadio, name, radioGroup)})
+			continue
+		}
+		channels, err := inf.listColumn(fmt.Sprintf(`show tag values from %q with key = "sensor-channel";`, name))
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, migration{from: name, into: true,
+			query: fmt.Sprintf(`select "value" as %q into %q from %q where "sensor-channel" = '' and %%v group by %v;`,
+				name, measWeather, name, weatherGroup)})
+		for _, ch := range channels {
+			list = append(list, migration{from: name, into: true,
+				query: fmt.Sprintf(`select "value" as %q into %q from %q where "sensor-channel" = %v and %%v group by %v;`,
+					name+"-"+ch, measWeather, name, quoteString(ch), weatherGroup)})
+		}
+	}
+	return list, nil
+}
+
+// timeRange returns the times of the first and last point of a
+// measurement, false when it is empty.
+func (inf *InfluxIf) timeRange(name string) (int64, int64, bool, error) {
+	var ends [2]int64
+	for i, f := range []string{"first", "last"} {
+		results, err := inf.query(fmt.Sprintf(`select %v("value") from %q;`, f, name))
+		if err != nil {
+			return 0, 0, false, err
+		}
+		if len(results[0].Series) == 0 || len(results[0].Series[0].Values) == 0 {
+			return 0, 0, false, nil
+		}
+		ts, ok := toInt(results[0].Series[0].Values[0][0])
+		if !ok {
+			return 0, 0, false, fmt.Errorf("invalid time in %v", name)
+		}
+		ends[i] = ts
+	}
+	return ends[0], ends[1], true, nil
+}
+
+// MigrateToWide copies data written with SchemaLegacy into the weather and
+// radio measurements of SchemaWide, a week at a time. The legacy
+// measurements are left in place. With dryRun the statements are only
+// logged.
+func (inf *InfluxIf) MigrateToWide(dryRun bool) error {
+	if inf.v2 != nil {
+		return errors.New("migration needs InfluxQL select into, only available on InfluxDB 1.x")
+	}
+	list, err := inf.migrations()
+	if err != nil {
+		return err
+	}
+	for _, m := range list {
+		first, last, ok, err := inf.timeRange(m.from)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		step := int64(migrateChunk)
+		for start := first - first%step; start <= last; start += step {
+			q := fmt.Sprintf(m.query, fmt.Sprintf("time >= %v and time < %v", start, start+step))
+			slog.Info("Migration", "query", q)
+			if dryRun {
+				continue
+			}
+			err = inf.migrateChunk(m, q)
+			if err != nil {
+				return fmt.Errorf("migration failed on %v: %v", q, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (inf *InfluxIf) migrateChunk(m migration, q string) error {
+	results, err := inf.query(q)
+	if err != nil {
+		return err
+	}
+	if m.into {
+		for _, row := range results[0].Series {
+			if len(row.Values) > 0 && len(row.Values[0]) > 1 {
+				slog.Info("Points written", "points", row.Values[0][1])
+			}
+		}
+		return nil
+	}
+	bp, err := inf.newBatch()
+	if err != nil {
+		return err
+	}
+	written := 0
+	for _, row := range results[0].Series {
+		tags := make(map[string]string, len(row.Tags))
+		for k, v := range row.Tags {
+			if v != "" {
+				tags[k] = v
+			}
+		}
+		for _, v := range row.Values {
+			pt, err := radioPoint(m.from, tags, v)
+			if err != nil {
+				return err
+			}
+			if pt == nil {
+				continue
+			}
+			bp.AddPoint(pt)
+			if len(bp.Points()) < migrateBatch {
+				continue
+			}
+			err = inf.write(bp)
+			if err != nil {
+				return err
+			}
+			written += len(bp.Points())
+			bp, err = inf.newBatch()
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if len(bp.Points()) > 0 {
+		err = inf.write(bp)
+		if err != nil {
+			return err
+		}
+		written += len(bp.Points())
+	}
+	slog.Info("Points written", "points", written)
+	return nil
+}
+
+// radioPoint turns a time, value and frequency row of a legacy gateway
+// measurement into a radio point. Rows without a value are skipped.
+func radioPoint(name string, tags map[string]string, row []interface{}) (*client.Point, error) {
+	if len(row) < 3 {
+		return nil, nil
+	}
+	ts, ok := toInt(row[0])
+	if !ok {
+		return nil, nil
+	}
+	value, ok := toFloat(row[1])
+	if !ok {
+		return nil, nil
+	}
+	fields := map[string]interface{}{name: value}
+	if s, ok := row[2].(string); ok {
+		freq, err := strconv.ParseFloat(s, 64)
+		if err == nil {
+			fields["frequency"] = freq
+		}
+	}
+	return client.NewPoint(measRadio, tags, fields, time.Unix(0, ts))
+}
@@ -0,0 +1,98 @@
+package influxif
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/influxdata/influxdb/models"
+)
+
+func TestMigrateToWide(t *testing.T) {
+	week := int64(migrateChunk)
+	// The data spans two chunks.
+	first, last := 3*week+5, 4*week+7
+	ends := func(name string) map[string][]models.Row {
+		at := func(ts int64) []models.Row {
+			return []models.Row{{Values: [][]interface{}{{json.Number(fmt.Sprint(ts)), json.Number("1")}}}}
+		}
+		return map[string][]models.Row{
+			fmt.Sprintf(`select first("value") from %q;`, name): at(first),
+			fmt.Sprintf(`select last("value") from %q;`, name):  at(last),
+		}
+	}
+	results := map[string][]models.Row{
+		"show measurements;": {{Values: [][]interface{}{
+			{"temperature"}, {"rssi"}, {"snr"}, {"frequency"}, {"packet-loss"}, {"weather"},
+		}}},
+		`show tag values from "temperature" with key = "sensor-channel";`: {{Values: [][]interface{}{
+			{"sensor-channel", "1"},
+		}}},
+		fmt.Sprintf(`select "value", "frequency" from "rssi" where time >= %v and time < %v group by %v;`, 3*week, 4*week, radioGroup): {{
+			Tags: map[string]string{"device-id": "node1", "gtw_id": "gw1", "channel": "2", "port": "1", "coding_rate": ""},
+			Values: [][]interface{}{
+				{json.Number(fmt.Sprint(first)), json.Number("-80"), "868.1"},
+				{json.Number(fmt.Sprint(first + 1)), json.Number("-81"), "not a number"},
+			},
+		}},
+	}
+	for _, name := range []string{"temperature", "rssi", "snr"} {
+		for k, v := range ends(name) {
+			results[k] = v
+		}
+	}
+
+	b := &fakeBackend{results: results}
+	inf := &InfluxIf{cli: b}
+	err := inf.MigrateToWide(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want []string
+	for _, q := range []string{
+		`select "value" as "temperature" into "weather" from "temperature" where "sensor-channel" = '' and time >= %v and time < %v group by ` + weatherGroup + ";",
+		`select "value" as "temperature-1" into "weather" from "temperature" where "sensor-channel" = '1' and time >= %v and time < %v group by ` + weatherGroup + ";",
+		`select "value" as "snr" into "radio" from "snr" where time >= %v and time < %v group by ` + radioGroup + ";",
+	} {
+		for _, start := range []int64{3 * week, 4 * week} {
+			want = append(want, fmt.Sprintf(q, start, start+week))
+		}
+	}
+	if !reflect.DeepEqual(b.into, want) {
+		t.Errorf("got\n%v\nwant\n%v", strings.Join(b.into, "\n"), strings.Join(want, "\n"))
+	}
+
+	// The frequency tag joins the gateway point as a float field, as
+	// written live.
+	wantPoints := []string{
+		fmt.Sprintf("radio,channel=2,device-id=node1,gtw_id=gw1,port=1 frequency=868.1,rssi=-80 %v", first),
+		fmt.Sprintf("radio,channel=2,device-id=node1,gtw_id=gw1,port=1 rssi=-81 %v", first+1),
+	}
+	if !reflect.DeepEqual(b.written, wantPoints) {
+		t.Errorf("got points\n%v\nwant\n%v", strings.Join(b.written, "\n"), strings.Join(wantPoints, "\n"))
+	}
+	for _, q := range b.into {
+		if strings.Contains(q, "quality") || strings.Contains(q, "packet-loss") || strings.Contains(q, `from "frequency"`) {
+			t.Errorf("unexpected migration %v", q)
+		}
+	}
+}
+
+func TestMigrateToWideDryRun(t *testing.T) {
+	b := &fakeBackend{results: map[string][]models.Row{
+		"show measurements;":                {{Values: [][]interface{}{{"snr"}}}},
+		`select first("value") from "snr";`: {{Values: [][]interface{}{{json.Number("0"), json.Number("1")}}}},
+		`select last("value") from "snr";`:  {{Values: [][]interface{}{{json.Number(fmt.Sprint(int64(time.Hour))), json.Number("1")}}}},
+	}}
+	inf := &InfluxIf{cli: b}
+	err := inf.MigrateToWide(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b.into) != 0 || len(b.written) != 0 {
+		t.Errorf("dry run migrated %v %v", b.into, b.written)
+	}
+}
@@ -0,0 +1,200 @@
+package influxif
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ncthompson/ThingsWeather/interfaces/sink"
+)
+
+// quoteString quotes s as an InfluxQL string literal.
+func quoteString(s string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(s) + "'"
+}
+
+// wanted reports whether a stored key was asked for and returns it as
+// name/channel. A field without a channel also selects all its channels.
+// Wide schema fields separate the channel with sep "-".
+func wanted(key string, fields []string, sep string) (string, bool) {
+	for _, f := range fields {
+		stored := strings.Replace(f, "/", sep, 1)
+		if key == stored {
+			return f, true
+		}
+		if !strings.Contains(f, "/") && strings.HasPrefix(key, f+sep) {
+			return f + "/" + strings.TrimPrefix(key, f+sep), true
+		}
+	}
+	return "", false
+}
+
+// Query returns the stored payload values of a station. Fields are
+// measurement names, name/channel selects one sensor channel.
+func (inf *InfluxIf) Query(station string, from, to time.Time, fields []string) ([]sink.Row, error) {
+	if len(fields) == 0 {
+		return nil, errors.New("no fields requested")
+	}
+	rows := make(map[int64]*sink.Row)
+	add := func(ts int64, key string, value float64) {
+		row := rows[ts]
+		if row == nil {
+			row = &sink.Row{Time: time.Unix(0, ts).UTC(), Values: make(map[string]float64)}
+			rows[ts] = row
+		}
+		row.Values[key] = value
+	}
+
+	var err error
+	switch {
+	case inf.useFlux():
+		err = inf.queryFlux(station, from, to, fields, add)
+	case inf.wide():
+		err = inf.queryWide(station, from, to, fields, add)
+	default:
+		err = inf.queryLegacy(station, from, to, fields, add)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]sink.Row, 0, len(rows))
+	for _, row := range rows {
+		list = append(list, *row)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Time.Before(list[j].Time)
+	})
+	return list, nil
+}
+
+// measurementNames are the measurements holding the fields.
+func measurementNames(fields []string) []string {
+	seen := make(map[string]bool)
+	names := make([]string, 0, len(fields))
+	for _, f := range fields {
+		name := strings.SplitN(f, "/", 2)[0]
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+func (inf *InfluxIf) queryLegacy(station string, from, to time.Time, fields []string, add func(int64, string, float64)) error {
+	names := measurementNames(fields)
+	quoted := make([]string, len(names))
+	for i, name := range names {
+		quoted[i] = fmt.Sprintf("%q", name)
+	}
+	results, err := inf.query(fmt.Sprintf(`select "value" from %v where "device-id" = %v and time >= %v and time <= %v group by "sensor-channel";`,
+		strings.Join(quoted, ", "), quoteString(station), from.UnixNano(), to.UnixNano()))
+	if err != nil {
+		return err
+	}
+	for _, result := range results {
+		for _, series := range result.Series {
+			key := series.Name
+			if ch := series.Tags["sensor-channel"]; ch != "" {
+				key += "/" + ch
+			}
+			key, ok := wanted(key, fields, "/")
+			if !ok {
+				continue
+			}
+			for _, v := range series.Values {
+				ts, ok := toInt(v[0])
+				value, okV := toFloat(v[1])
+				if ok && okV {
+					add(ts, key, value)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (inf *InfluxIf) queryWide(station string, from, to time.Time, fields []string, add func(int64, string, float64)) error {
+	results, err := inf.query(fmt.Sprintf(`select * from %q where "device-id" = %v and time >= %v and time <= %v;`,
+		measWeather, quoteString(station), from.UnixNano(), to.UnixNano()))
+	if err != nil {
+		return err
+	}
+	for _, result := range results {
+		for _, series := range result.Series {
+			for _, v := range series.Values {
+				ts, ok := toInt(v[0])
+				if !ok {
+					continue
+				}
+				for i := 1; i < len(series.Columns) && i < len(v); i++ {
+					column := series.Columns[i]
+					if strings.HasSuffix(column, "-quality") {
+						continue
+					}
+					key, ok := wanted(column, fields, "-")
+					if !ok {
+						continue
+					}
+					// Tags come back as strings and are skipped here.
+					value, ok := toFloat(v[i])
+					if ok {
+						add(ts, key, value)
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (inf *InfluxIf) queryFlux(station string, from, to time.Time, fields []string, add func(int64, string, float64)) error {
+	var filter []string
+	sep := "/"
+	if inf.wide() {
+		sep = "-"
+		filter = []string{fmt.Sprintf("r._measurement == %q", measWeather)}
+	} else {
+		for _, name := range measurementNames(fields) {
+			filter = append(filter, fmt.Sprintf(`(r._measurement == %q and r._field == "value")`, name))
+		}
+	}
+	query := fmt.Sprintf(`from(bucket: %q)
+  |> range(start: %v, stop: %v)
+  |> filter(fn: (r) => r["device-id"] == %q)
+  |> filter(fn: (r) => %v)`, inf.conf.Bucket, from.Format(time.RFC3339Nano),
+		to.Add(time.Nanosecond).Format(time.RFC3339Nano), station, strings.Join(filter, " or "))
+	rows, err := inf.v2.flux(query)
+	if err != nil {
+		return err
+	}
+	for _, row := range rows {
+		key := row["_measurement"]
+		if inf.wide() {
+			key = row["_field"]
+		} else if ch := row["sensor-channel"]; ch != "" {
+			key += "/" + ch
+		}
+		if strings.HasSuffix(key, "-quality") {
+			continue
+		}
+		key, ok := wanted(key, fields, sep)
+		if !ok {
+			continue
+		}
+		ts, err := time.Parse(time.RFC3339Nano, row["_time"])
+		if err != nil {
+			return err
+		}
+		value, err := strconv.ParseFloat(row["_value"], 64)
+		if err != nil {
+			continue
+		}
+		add(ts.UnixNano(), key, value)
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package influxif
+
+import (
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ncthompson/ThingsWeather/interfaces/sink"
+	"github.com/ncthompson/ThingsWeather/interfaces/thingsif"
+)
+
+// lines returns the line protocol of an observation, sorted.
+func lines(t *testing.T, conf InfluxConfig, obs *sink.Observation) []string {
+	t.Helper()
+	conf.HostAddress = "http://localhost:8086"
+	inf, err := NewClient(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bp, err := inf.obsToBatch(obs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out []string
+	for _, pt := range bp.Points() {
+		out = append(out, pt.PrecisionString("s"))
+	}
+	sort.Strings(out)
+	return out
+}
+
+func testObservation() *sink.Observation {
+	ts := time.Unix(1714564800, 0)
+	p := &thingsif.Payload{Valid: true}
+	p.Add(thingsif.MeasTemperature, 20.5, "degC")
+	p.Add(thingsif.MeasHumidity, 60, "%RH").Quality = "suspect"
+	u := &thingsif.Uplink{
+		DevID: "node1", HWSerial: "0102", Port: 1, Time: ts, Payload: p,
+		Frequency: 868.1, Modulation: "LORA", DataRate: "SF7BW125", CodingRate: "4/5",
+		Gateways: []*thingsif.GwMetadata{{GtwID: "gw1", RSSI: -80, SNR: 7.5, Channel: 2}},
+	}
+	return sink.FromUplink(u)
+}
+
+func TestSchemaWide(t *testing.T) {
+	got := lines(t, InfluxConfig{Schema: SchemaWide}, testObservation())
+	want := []string{
+		"radio,channel=2,coding_rate=4/5,data_rate=SF7BW125,device-id=node1,gtw_id=gw1,hardware-serial=0102,modulation=LORA,port=1 altitude=0,frequency=868.1,latitude=0,longitude=0,rssi=-80,snr=7.5 1714564800",
+		`weather,device-id=node1,hardware-serial=0102,port=1 humidity=60,humidity-quality="suspect",temperature=20.5 1714564800`,
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got\n%v\nwant\n%v", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestSchemaLegacy(t *testing.T) {
+	obs := testObservation()
+	obs.Payload.Add(thingsif.MeasTemperature, 18.25, "degC").Channel = "1"
+	got := lines(t, InfluxConfig{}, obs)
+	tags := "device-id=node1,hardware-serial=0102,port=1"
+	gw := "channel=2,coding_rate=4/5,data_rate=SF7BW125,device-id=node1,frequency=868.1,gtw_id=gw1,hardware-serial=0102,modulation=LORA,port=1"
+	want := []string{
+		"altitude," + gw + " value=0 1714564800",
+		"frequency,coding_rate=4/5,data_rate=SF7BW125,device-id=node1,hardware-serial=0102,modulation=LORA,port=1 value=868.1 1714564800",
+		"humidity," + tags + " value=60 1714564800",
+		"latitude," + gw + " value=0 1714564800",
+		"longitude," + gw + " value=0 1714564800",
+		"rssi," + gw + " value=-80 1714564800",
+		"snr," + gw + " value=7.5 1714564800",
+		"temperature," + tags + " value=20.5 1714564800",
+		"temperature," + tags + ",sensor-channel=1 value=18.25 1714564800",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got\n%v\nwant\n%v", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
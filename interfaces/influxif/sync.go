@@ -0,0 +1,222 @@
+package influxif
+
+import (
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/influxdata/influxdb/client/v2"
+	"github.com/ncthompson/ThingsWeather/interfaces/sink"
+	"github.com/ncthompson/ThingsWeather/interfaces/thingsif"
+)
+
+// syncChunk limits the number of points per write while syncing.
+const syncChunk = 5000
+
+// truncate rounds ts down to the write precision, matching the
+// timestamps the database stores.
+func (inf *InfluxIf) truncate(ts time.Time) int64 {
+	switch inf.writePrecision() {
+	case "us":
+		return ts.Truncate(time.Microsecond).UnixNano()
+	case "ms":
+		return ts.Truncate(time.Millisecond).UnixNano()
+	case "s":
+		return ts.Truncate(time.Second).UnixNano()
+	}
+	return ts.UnixNano()
+}
+
+// syncMeasurements lists the measurements a history row may be stored in.
+func (inf *InfluxIf) syncMeasurements(data []*thingsif.Uplink) []string {
+	if inf.wide() {
+		return []string{measWeather}
+	}
+	seen := make(map[string]bool)
+	for _, u := range data {
+		if u.Payload == nil {
+			continue
+		}
+		for _, m := range u.Payload.Measurements {
+			seen[m.Name] = true
+		}
+	}
+	names := make([]string, 0, len(seen))
+	for name := range seen {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// existingTimes returns the stored timestamps per device between start
+// and stop, inclusive, for any of the measurements.
+func (inf *InfluxIf) existingTimes(names []string, start, stop time.Time) (map[string]map[int64]bool, error) {
+	times := make(map[string]map[int64]bool)
+	add := func(dev string, ts int64) {
+		if times[dev] == nil {
+			times[dev] = make(map[int64]bool)
+		}
+		times[dev][ts] = true
+	}
+
+	if inf.useFlux() {
+		filter := make([]string, len(names))
+		for i, name := range names {
+			filter[i] = fmt.Sprintf("r._measurement == %q", name)
+		}
+		query := fmt.Sprintf(`from(bucket: %q)
+  |> range(start: %v, stop: %v)
+  |> filter(fn: (r) => %v)
+  |> keep(columns: ["_time", "device-id"])`, inf.conf.Bucket, start.Format(time.RFC3339Nano),
+			stop.Add(time.Nanosecond).Format(time.RFC3339Nano), strings.Join(filter, " or "))
+		rows, err := inf.v2.flux(query)
+		if err != nil {
+			return nil, err
+		}
+		for _, row := range rows {
+			ts, err := time.Parse(time.RFC3339Nano, row["_time"])
+			if err != nil {
+				return nil, err
+			}
+			add(row["device-id"], ts.UnixNano())
+		}
+		return times, nil
+	}
+
+	from := make([]string, len(names))
+	for i, name := range names {
+		from[i] = fmt.Sprintf("%q", name)
+	}
+	field := `"value"`
+	if inf.wide() {
+		field = "*"
+	}
+	query := fmt.Sprintf(`select %v from %v where time >= %v and time <= %v group by "device-id";`,
+		field, strings.Join(from, ", "), start.UnixNano(), stop.UnixNano())
+	response, err := inf.cli.Query(client.NewQuery(query, inf.conf.Database, precision))
+	if err != nil {
+		return nil, err
+	}
+	if response.Error() != nil {
+		return nil, response.Error()
+	}
+	for _, result := range response.Results {
+		for _, row := range result.Series {
+			for _, v := range row.Values {
+				ts, ok := toInt(v[0])
+				if ok {
+					add(row.Tags["device-id"], ts)
+				}
+			}
+		}
+	}
+	return times, nil
+}
+
+// Backfill writes the history uplinks not yet in the database with the
+// same points and tags as live uplinks. Existing timestamps for the whole
+// window are fetched in one query per call and compared per device. With
+// dryRun set nothing is written. Inserted only counts uplinks whose write
+// succeeded.
+func (inf *InfluxIf) Backfill(data []*thingsif.Uplink, dryRun bool) (map[string]*sink.SyncCount, error) {
+	counts := make(map[string]*sink.SyncCount)
+	if len(data) == 0 {
+		return counts, nil
+	}
+	var start, stop time.Time
+	for _, u := range data {
+		ts := u.Time
+		if start.IsZero() || ts.Before(start) {
+			start = ts
+		}
+		if ts.After(stop) {
+			stop = ts
+		}
+	}
+
+	names := inf.syncMeasurements(data)
+	existing := make(map[string]map[int64]bool)
+	if len(names) > 0 {
+		var err error
+		existing, err = inf.existingTimes(names, time.Unix(0, inf.truncate(start)), stop)
+		if err != nil {
+			return counts, err
+		}
+	}
+
+	bp, err := inf.newBatch()
+	if err != nil {
+		return counts, err
+	}
+	// Uplinks per device in bp, counted as inserted once written.
+	pending := make(map[string]int)
+	write := func() error {
+		err := inf.cli.Write(bp)
+		if err != nil {
+			return err
+		}
+		for dev, n := range pending {
+			counts[dev].Inserted += n
+		}
+		pending = make(map[string]int)
+		return nil
+	}
+	for _, u := range data {
+		count := counts[u.DevID]
+		if count == nil {
+			count = &sink.SyncCount{}
+			counts[u.DevID] = count
+		}
+		if u.Payload == nil || !u.Payload.Valid {
+			count.Invalid++
+			continue
+		}
+		if existing[u.DevID][inf.truncate(u.Time)] {
+			count.Skipped++
+			continue
+		}
+		count.Missing++
+		if dryRun {
+			continue
+		}
+		err = inf.setUplink(u, u.Payload, bp)
+		if err != nil {
+			return counts, err
+		}
+		pending[u.DevID]++
+		if len(bp.Points()) >= syncChunk {
+			err = write()
+			if err != nil {
+				return counts, err
+			}
+			bp, err = inf.newBatch()
+			if err != nil {
+				return counts, err
+			}
+		}
+	}
+	if len(bp.Points()) > 0 {
+		err = write()
+	}
+	return counts, err
+}
+
+// SyncDatabase writes missing history uplinks and logs the result per
+// device.
+func (inf *InfluxIf) SyncDatabase(data []*thingsif.Uplink) error {
+	slog.Info("Sync", "entries", len(data))
+	counts, err := inf.Backfill(data, false)
+	devs := make([]string, 0, len(counts))
+	for dev := range counts {
+		devs = append(devs, dev)
+	}
+	sort.Strings(devs)
+	for _, dev := range devs {
+		c := counts[dev]
+		slog.Info("Synced", "device", dev, "inserted", c.Inserted, "skipped", c.Skipped, "invalid", c.Invalid)
+	}
+	return err
+}
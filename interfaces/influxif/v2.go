@@ -0,0 +1,223 @@
+package influxif
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/influxdata/influxdb/client/v2"
+	"github.com/ncthompson/ThingsWeather/interfaces/sink"
+)
+
+const (
+	queryInfluxQL = "influxql"
+	queryFlux     = "flux"
+)
+
+// backend is the part of the 1.x client used by InfluxIf, so the token
+// based API of InfluxDB 2.x and 3.x can stand in for it.
+type backend interface {
+	Write(bp client.BatchPoints) error
+	Query(q client.Query) (*client.Response, error)
+	Close() error
+}
+
+// v2Client talks to the /api/v2 write endpoint and reads through either
+// the InfluxQL compatibility endpoint or Flux.
+type v2Client struct {
+	conf InfluxConfig
+	addr *url.URL
+	http *http.Client
+}
+
+func newV2Client(conf InfluxConfig) (*v2Client, error) {
+	if conf.Token == "" || conf.Bucket == "" {
+		return nil, errors.New("InfluxDB 2 requires a token and bucket")
+	}
+	addr, err := url.Parse(conf.HostAddress)
+	if err != nil {
+		return nil, err
+	}
+	switch conf.QueryLanguage {
+	case "", queryInfluxQL, queryFlux:
+	default:
+		return nil, fmt.Errorf("unknown query language: %v", conf.QueryLanguage)
+	}
+	return &v2Client{
+		conf: conf,
+		addr: addr,
+		http: &http.Client{Timeout: 30 * time.Second},
+	}, nil
+}
+
+func (c *v2Client) endpoint(path string, params url.Values) string {
+	u := *c.addr
+	u.Path = strings.TrimSuffix(u.Path, "/") + path
+	u.RawQuery = params.Encode()
+	return u.String()
+}
+
+func (c *v2Client) do(req *http.Request, expect int) ([]byte, error) {
+	req.Header.Set("Authorization", "Token "+c.conf.Token)
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != expect {
+		err = fmt.Errorf("influxdb: %v: %v", resp.Status, strings.TrimSpace(string(body)))
+		switch resp.StatusCode {
+		case http.StatusBadRequest, http.StatusRequestEntityTooLarge, http.StatusUnprocessableEntity:
+			// The request itself is refused, sending it again cannot help.
+			return nil, sink.Permanent(err)
+		}
+		return nil, err
+	}
+	return body, nil
+}
+
+// Write sends the batch as line protocol.
+func (c *v2Client) Write(bp client.BatchPoints) error {
+	var buf bytes.Buffer
+	var w io.Writer = &buf
+	var zw *gzip.Writer
+	if c.conf.Gzip {
+		zw = gzip.NewWriter(&buf)
+		w = zw
+	}
+	for _, pt := range bp.Points() {
+		_, err := io.WriteString(w, pt.PrecisionString(bp.Precision())+"\n")
+		if err != nil {
+			return err
+		}
+	}
+	if zw != nil {
+		err := zw.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	params := url.Values{}
+	params.Set("org", c.conf.Org)
+	params.Set("bucket", c.conf.Bucket)
+	params.Set("precision", bp.Precision())
+	req, err := http.NewRequest("POST", c.endpoint("/api/v2/write", params), &buf)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if zw != nil {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	_, err = c.do(req, http.StatusNoContent)
+	return err
+}
+
+// Query runs InfluxQL against the bucket through the 1.x compatible
+// /query endpoint.
+func (c *v2Client) Query(q client.Query) (*client.Response, error) {
+	params := url.Values{}
+	params.Set("db", c.conf.Bucket)
+	params.Set("q", q.Command)
+	if q.Precision != "" {
+		params.Set("epoch", q.Precision)
+	}
+	req, err := http.NewRequest("GET", c.endpoint("/query", params), nil)
+	if err != nil {
+		return nil, err
+	}
+	body, err := c.do(req, http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+	response := &client.Response{}
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	err = dec.Decode(response)
+	if err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+// flux runs a Flux query and returns the result rows keyed by column.
+func (c *v2Client) flux(query string) ([]map[string]string, error) {
+	payload, err := json.Marshal(map[string]interface{}{
+		"query": query,
+		"type":  "flux",
+		"dialect": map[string]interface{}{
+			"header":      true,
+			"annotations": []string{},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	params := url.Values{}
+	params.Set("org", c.conf.Org)
+	req, err := http.NewRequest("POST", c.endpoint("/api/v2/query", params), bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/csv")
+	body, err := c.do(req, http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+	return parseFluxCSV(body)
+}
+
+// parseFluxCSV reads the annotated CSV of a Flux result without
+// annotations. Every table starts with its own header row, tables of one
+// result may have different columns.
+func parseFluxCSV(body []byte) ([]map[string]string, error) {
+	r := csv.NewReader(bytes.NewReader(body))
+	r.FieldsPerRecord = -1
+	rows := make([]map[string]string, 0)
+	var header []string
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		// The blank line between tables is skipped by the reader, a new
+		// table is recognised by its header.
+		if header == nil || isFluxHeader(record) {
+			header = record
+			continue
+		}
+		row := make(map[string]string, len(header))
+		for i := 0; i < len(header) && i < len(record); i++ {
+			row[header[i]] = record[i]
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+// isFluxHeader reports whether a record is the header row of a table.
+func isFluxHeader(record []string) bool {
+	return len(record) >= 3 && record[0] == "" && record[1] == "result" && record[2] == "table"
+}
+
+func (c *v2Client) Close() error {
+	c.http.CloseIdleConnections()
+	return nil
+}
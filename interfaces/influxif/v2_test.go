@@ -0,0 +1,156 @@
+package influxif
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/influxdata/influxdb/client/v2"
+)
+
+func TestParseFluxCSV(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want []map[string]string
+	}{{
+		name: "empty",
+		body: "",
+		want: []map[string]string{},
+	}, {
+		name: "one table",
+		body: ",result,table,_time,_value\r\n" +
+			",_result,0,2024-05-01T12:00:00Z,20.5\r\n" +
+			",_result,0,2024-05-01T12:01:00Z,20.7\r\n\r\n",
+		want: []map[string]string{
+			{"": "", "result": "_result", "table": "0", "_time": "2024-05-01T12:00:00Z", "_value": "20.5"},
+			{"": "", "result": "_result", "table": "0", "_time": "2024-05-01T12:01:00Z", "_value": "20.7"},
+		},
+	}, {
+		name: "tables with different columns",
+		body: ",result,table,_time,_value,_measurement\r\n" +
+			",_result,0,2024-05-01T12:00:00Z,20.5,temperature\r\n" +
+			"\r\n" +
+			",result,table,_time,_value,_measurement,sensor-channel\r\n" +
+			",_result,1,2024-05-01T12:00:00Z,18.1,temperature,1\r\n\r\n",
+		want: []map[string]string{
+			{"": "", "result": "_result", "table": "0", "_time": "2024-05-01T12:00:00Z", "_value": "20.5",
+				"_measurement": "temperature"},
+			{"": "", "result": "_result", "table": "1", "_time": "2024-05-01T12:00:00Z", "_value": "18.1",
+				"_measurement": "temperature", "sensor-channel": "1"},
+		},
+	}, {
+		name: "quoted values",
+		body: ",result,table,device-id\r\n" +
+			`,_result,0,"node,1"` + "\r\n",
+		want: []map[string]string{
+			{"": "", "result": "_result", "table": "0", "device-id": "node,1"},
+		},
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseFluxCSV([]byte(tt.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestV2Write(t *testing.T) {
+	var got string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v2/write" || r.Header.Get("Authorization") != "Token secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		q := r.URL.Query()
+		if q.Get("org") != "home" || q.Get("bucket") != "weather" || q.Get("precision") != "s" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		var body io.Reader = r.Body
+		if r.Header.Get("Content-Encoding") == "gzip" {
+			zr, err := gzip.NewReader(r.Body)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			body = zr
+		}
+		data, _ := io.ReadAll(body)
+		got = string(data)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	for _, gz := range []bool{false, true} {
+		c, err := newV2Client(InfluxConfig{HostAddress: srv.URL, Token: "secret", Org: "home", Bucket: "weather", Gzip: gz})
+		if err != nil {
+			t.Fatal(err)
+		}
+		bp, _ := client.NewBatchPoints(client.BatchPointsConfig{Precision: "s"})
+		pt, _ := client.NewPoint("temperature", map[string]string{"device-id": "node1"},
+			map[string]interface{}{"value": 20.5}, time.Unix(1714564800, 0))
+		bp.AddPoint(pt)
+		err = c.Write(bp)
+		if err != nil {
+			t.Fatalf("gzip %v: %v", gz, err)
+		}
+		want := "temperature,device-id=node1 value=20.5 1714564800\n"
+		if got != want {
+			t.Errorf("gzip %v: got %q, want %q", gz, got, want)
+		}
+	}
+}
+
+func TestV2WriteError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"code":"invalid","message":"field type conflict"}`, http.StatusBadRequest)
+	}))
+	defer srv.Close()
+	c, err := newV2Client(InfluxConfig{HostAddress: srv.URL, Token: "secret", Bucket: "weather"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bp, _ := client.NewBatchPoints(client.BatchPointsConfig{})
+	err = c.Write(bp)
+	if err == nil || !strings.Contains(err.Error(), "field type conflict") {
+		t.Errorf("got %v, want the server error", err)
+	}
+}
+
+func TestQueryFluxLegacy(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/csv")
+		io.WriteString(w, ",result,table,_time,_value,_field,_measurement,device-id\r\n"+
+			",_result,0,2024-05-01T12:00:00Z,20.5,value,temperature,node1\r\n"+
+			",_result,1,2024-05-01T12:00:00Z,60,value,humidity,node1\r\n"+
+			"\r\n"+
+			",result,table,_time,_value,_field,_measurement,device-id,sensor-channel\r\n"+
+			",_result,2,2024-05-01T12:00:00Z,18.1,value,temperature,node1,1\r\n\r\n")
+	}))
+	defer srv.Close()
+	inf, err := NewClient(InfluxConfig{HostAddress: srv.URL, Version: 2, Token: "secret", Bucket: "weather",
+		QueryLanguage: queryFlux})
+	if err != nil {
+		t.Fatal(err)
+	}
+	from := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	rows, err := inf.Query("node1", from, from.Add(24*time.Hour), []string{"temperature", "humidity"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]float64{"temperature": 20.5, "temperature/1": 18.1, "humidity": 60}
+	if len(rows) != 1 || !reflect.DeepEqual(rows[0].Values, want) {
+		t.Errorf("got %+v, want one row with %v", rows, want)
+	}
+}
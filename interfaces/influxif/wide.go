@@ -0,0 +1,72 @@
+package influxif
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/influxdata/influxdb/client/v2"
+	"github.com/ncthompson/ThingsWeather/interfaces/thingsif"
+)
+
+const (
+	// SchemaLegacy writes one measurement with a value field per number.
+	SchemaLegacy = "legacy"
+	// SchemaWide writes one weather point per uplink holding all sensor
+	// fields and one radio point per gateway.
+	SchemaWide = "wide"
+
+	measWeather = "weather"
+	measRadio   = "radio"
+)
+
+// wideField names the field of a measurement in the weather point.
+func wideField(m *thingsif.Measurement) string {
+	if m.Channel == "" {
+		return m.Name
+	}
+	return m.Name + "-" + m.Channel
+}
+
+func setWeather(p *thingsif.Payload, t time.Time, tags map[string]string, bp client.BatchPoints) error {
+	if len(p.Measurements) == 0 {
+		return nil
+	}
+	fields := make(map[string]interface{}, len(p.Measurements))
+	for i := 0; i < len(p.Measurements); i++ {
+		m := p.Measurements[i]
+		name := wideField(m)
+		fields[name] = m.Value
+		if m.Quality != "" {
+			fields[name+"-quality"] = m.Quality
+		}
+	}
+	pt, err := client.NewPoint(measWeather, tags, fields, t)
+	if err != nil {
+		return err
+	}
+	bp.AddPoint(pt)
+	return nil
+}
+
+func setRadio(g *thingsif.GwMetadata, freq float64, t time.Time, tags map[string]string, bp client.BatchPoints) error {
+	tagsGW := make(map[string]string, len(tags)+2)
+	for k, v := range tags {
+		tagsGW[k] = v
+	}
+	tagsGW["gtw_id"] = g.GtwID
+	tagsGW["channel"] = strconv.Itoa(g.Channel)
+	fields := map[string]interface{}{
+		"rssi":      g.RSSI,
+		"snr":       g.SNR,
+		"frequency": freq,
+		"altitude":  g.Altitude,
+		"latitude":  g.Latitude,
+		"longitude": g.Longitude,
+	}
+	pt, err := client.NewPoint(measRadio, tagsGW, fields, t)
+	if err != nil {
+		return err
+	}
+	bp.AddPoint(pt)
+	return nil
+}
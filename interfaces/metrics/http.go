@@ -0,0 +1,17 @@
+package metrics
+
+import (
+	"log/slog"
+	"net/http"
+)
+
+// Handler serves the metrics of the Default registry.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		err := Default.WriteText(w)
+		if err != nil {
+			slog.Error("Metrics write failed", "err", err)
+		}
+	})
+}
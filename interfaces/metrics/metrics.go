@@ -0,0 +1,334 @@
+// Package metrics keeps operational counters, gauges and histograms and
+// exposes them in the Prometheus text format.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefBuckets are the default histogram buckets in seconds.
+var DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// collector is a metric family that can write itself.
+type collector interface {
+	name() string
+	write(w io.Writer)
+}
+
+// Registry holds metric families by name.
+type Registry struct {
+	mu         sync.Mutex
+	collectors map[string]collector
+}
+
+// NewRegistry creates an empty registry.
+func NewRegistry() *Registry {
+	return &Registry{collectors: make(map[string]collector)}
+}
+
+// Default is the registry the New functions register with.
+var Default = NewRegistry()
+
+func (r *Registry) register(c collector) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.collectors[c.name()]; ok {
+		panic("metrics: duplicate metric " + c.name())
+	}
+	r.collectors[c.name()] = c
+}
+
+// WriteText writes all metrics in the Prometheus text exposition format.
+func (r *Registry) WriteText(w io.Writer) error {
+	r.mu.Lock()
+	names := make([]string, 0, len(r.collectors))
+	for name := range r.collectors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	collectors := make([]collector, len(names))
+	for i, name := range names {
+		collectors[i] = r.collectors[name]
+	}
+	r.mu.Unlock()
+
+	bw := bufio.NewWriter(w)
+	for _, c := range collectors {
+		c.write(bw)
+	}
+	return bw.Flush()
+}
+
+// desc is the name, help and label names of a metric family.
+type desc struct {
+	fqName string
+	help   string
+	typ    string
+	labels []string
+}
+
+func (d *desc) name() string {
+	return d.fqName
+}
+
+func (d *desc) header(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %v %v\n", d.fqName, strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(d.help))
+	fmt.Fprintf(w, "# TYPE %v %v\n", d.fqName, d.typ)
+}
+
+// key joins label values into a map key.
+func key(values []string) string {
+	return strings.Join(values, "\xff")
+}
+
+// labelPairs formats label names and values, plus an optional extra pair.
+func labelPairs(names, values []string, extra ...string) string {
+	if len(names) == 0 && len(extra) == 0 {
+		return ""
+	}
+	escape := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	pairs := make([]string, 0, len(names)+1)
+	for i, n := range names {
+		pairs = append(pairs, fmt.Sprintf(`%v="%v"`, n, escape.Replace(values[i])))
+	}
+	if len(extra) == 2 {
+		pairs = append(pairs, fmt.Sprintf(`%v="%v"`, extra[0], escape.Replace(extra[1])))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// valueVec is a family of float values by label values, used by counters
+// and gauges.
+type valueVec struct {
+	desc
+	mu     sync.Mutex
+	values map[string]float64
+	labels map[string][]string
+}
+
+func newValueVec(typ, name, help string, labels []string) *valueVec {
+	v := &valueVec{
+		desc:   desc{fqName: name, help: help, typ: typ, labels: labels},
+		values: make(map[string]float64),
+		labels: make(map[string][]string),
+	}
+	Default.register(v)
+	return v
+}
+
+func (v *valueVec) update(values []string, f func(float64) float64) {
+	if len(values) != len(v.desc.labels) {
+		panic(fmt.Sprintf("metrics: %v takes %v labels", v.fqName, len(v.desc.labels)))
+	}
+	k := key(values)
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if _, ok := v.labels[k]; !ok {
+		v.labels[k] = append([]string{}, values...)
+	}
+	v.values[k] = f(v.values[k])
+}
+
+func (v *valueVec) delete(values []string) {
+	k := key(values)
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	delete(v.values, k)
+	delete(v.labels, k)
+}
+
+func (v *valueVec) write(w io.Writer) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.header(w)
+	keys := make([]string, 0, len(v.values))
+	for k := range v.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(w, "%v%v %v\n", v.fqName, labelPairs(v.desc.labels, v.labels[k]), formatFloat(v.values[k]))
+	}
+}
+
+// CounterVec is a family of counters partitioned by labels.
+type CounterVec struct {
+	vec *valueVec
+}
+
+// NewCounterVec registers a counter family with the given label names.
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	return &CounterVec{vec: newValueVec("counter", name, help, labels)}
+}
+
+// Add increases the counter with the given label values by delta.
+func (c *CounterVec) Add(delta float64, values ...string) {
+	if delta < 0 {
+		panic("metrics: counter decreased")
+	}
+	c.vec.update(values, func(v float64) float64 { return v + delta })
+}
+
+// Inc increases the counter with the given label values by one.
+func (c *CounterVec) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+// Counter is a counter without labels.
+type Counter struct {
+	vec *CounterVec
+}
+
+// NewCounter registers a counter.
+func NewCounter(name, help string) *Counter {
+	c := &Counter{vec: NewCounterVec(name, help)}
+	c.vec.Add(0)
+	return c
+}
+
+// Inc increases the counter by one.
+func (c *Counter) Inc() {
+	c.vec.Add(1)
+}
+
+// Add increases the counter by delta.
+func (c *Counter) Add(delta float64) {
+	c.vec.Add(delta)
+}
+
+// GaugeVec is a family of gauges partitioned by labels.
+type GaugeVec struct {
+	vec *valueVec
+}
+
+// NewGaugeVec registers a gauge family with the given label names.
+func NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	return &GaugeVec{vec: newValueVec("gauge", name, help, labels)}
+}
+
+// Set sets the gauge with the given label values.
+func (g *GaugeVec) Set(value float64, values ...string) {
+	g.vec.update(values, func(float64) float64 { return value })
+}
+
+// Delete removes the gauge with the given label values.
+func (g *GaugeVec) Delete(values ...string) {
+	g.vec.delete(values)
+}
+
+// valueFunc is a counter or gauge read when the metrics are written.
+type valueFunc struct {
+	desc
+	f func() float64
+}
+
+// NewGaugeFunc registers a gauge whose value is read from f.
+func NewGaugeFunc(name, help string, f func() float64) {
+	Default.register(&valueFunc{desc: desc{fqName: name, help: help, typ: "gauge"}, f: f})
+}
+
+// NewCounterFunc registers a counter whose value is read from f.
+func NewCounterFunc(name, help string, f func() float64) {
+	Default.register(&valueFunc{desc: desc{fqName: name, help: help, typ: "counter"}, f: f})
+}
+
+func (g *valueFunc) write(w io.Writer) {
+	g.header(w)
+	fmt.Fprintf(w, "%v %v\n", g.fqName, formatFloat(g.f()))
+}
+
+type histogram struct {
+	labels []string
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// HistogramVec is a family of histograms partitioned by labels.
+type HistogramVec struct {
+	desc
+	buckets []float64
+	mu      sync.Mutex
+	hists   map[string]*histogram
+}
+
+// NewHistogramVec registers a histogram family with the given upper
+// bucket bounds, DefBuckets when nil, and label names.
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	if buckets == nil {
+		buckets = DefBuckets
+	}
+	buckets = append([]float64{}, buckets...)
+	sort.Float64s(buckets)
+	h := &HistogramVec{
+		desc:    desc{fqName: name, help: help, typ: "histogram", labels: labels},
+		buckets: buckets,
+		hists:   make(map[string]*histogram),
+	}
+	Default.register(h)
+	return h
+}
+
+// Observe adds a value to the histogram with the given label values.
+func (h *HistogramVec) Observe(value float64, values ...string) {
+	if len(values) != len(h.desc.labels) {
+		panic(fmt.Sprintf("metrics: %v takes %v labels", h.fqName, len(h.desc.labels)))
+	}
+	k := key(values)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	hist, ok := h.hists[k]
+	if !ok {
+		hist = &histogram{
+			labels: append([]string{}, values...),
+			counts: make([]uint64, len(h.buckets)),
+		}
+		h.hists[k] = hist
+	}
+	for i, b := range h.buckets {
+		if value <= b {
+			hist.counts[i]++
+		}
+	}
+	hist.count++
+	hist.sum += value
+}
+
+func (h *HistogramVec) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.header(w)
+	keys := make([]string, 0, len(h.hists))
+	for k := range h.hists {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		hist := h.hists[k]
+		for i, b := range h.buckets {
+			fmt.Fprintf(w, "%v_bucket%v %v\n", h.fqName, labelPairs(h.desc.labels, hist.labels, "le", formatFloat(b)), hist.counts[i])
+		}
+		fmt.Fprintf(w, "%v_bucket%v %v\n", h.fqName, labelPairs(h.desc.labels, hist.labels, "le", "+Inf"), hist.count)
+		fmt.Fprintf(w, "%v_sum%v %v\n", h.fqName, labelPairs(h.desc.labels, hist.labels), formatFloat(hist.sum))
+		fmt.Fprintf(w, "%v_count%v %v\n", h.fqName, labelPairs(h.desc.labels, hist.labels), hist.count)
+	}
+}
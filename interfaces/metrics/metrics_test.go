@@ -0,0 +1,145 @@
+package metrics
+
+import (
+	"bytes"
+	"math"
+	"strings"
+	"testing"
+)
+
+// text returns what a metric family writes.
+func text(c collector) string {
+	var buf bytes.Buffer
+	c.write(&buf)
+	return buf.String()
+}
+
+func TestCounterVec(t *testing.T) {
+	c := NewCounterVec("test_uplinks_total", "Uplinks by \\ device\nand port.", "device", "port")
+	c.Inc("node2", "1")
+	c.Add(2, "node1", "2")
+	c.Inc("node1", "2")
+	c.Inc(`a"b\c`+"\n", "1")
+	want := `# HELP test_uplinks_total Uplinks by \\ device\nand port.
+# TYPE test_uplinks_total counter
+test_uplinks_total{device="a\"b\\c\n",port="1"} 1
+test_uplinks_total{device="node1",port="2"} 3
+test_uplinks_total{device="node2",port="1"} 1
+`
+	if got := text(c.vec); got != want {
+		t.Errorf("got\n%v\nwant\n%v", got, want)
+	}
+}
+
+func TestCounterDecrease(t *testing.T) {
+	c := NewCounterVec("test_decrease_total", "Decreased.")
+	defer func() {
+		if recover() == nil {
+			t.Error("counter decreased without a panic")
+		}
+	}()
+	c.Add(-1)
+}
+
+func TestLabelCount(t *testing.T) {
+	g := NewGaugeVec("test_labels", "Labels.", "device")
+	defer func() {
+		if recover() == nil {
+			t.Error("wrong number of labels accepted")
+		}
+	}()
+	g.Set(1, "node1", "extra")
+}
+
+func TestGaugeVec(t *testing.T) {
+	g := NewGaugeVec("test_loss_ratio", "Loss.", "device", "window")
+	g.Set(0.5, "node1", "1h")
+	g.Set(0.25, "node1", "1h")
+	g.Set(math.Inf(1), "node2", "1h")
+	g.Set(math.NaN(), "node3", "1h")
+	g.Set(1, "node4", "1h")
+	g.Delete("node4", "1h")
+	want := `# HELP test_loss_ratio Loss.
+# TYPE test_loss_ratio gauge
+test_loss_ratio{device="node1",window="1h"} 0.25
+test_loss_ratio{device="node2",window="1h"} +Inf
+test_loss_ratio{device="node3",window="1h"} NaN
+`
+	if got := text(g.vec); got != want {
+		t.Errorf("got\n%v\nwant\n%v", got, want)
+	}
+}
+
+func TestCounter(t *testing.T) {
+	c := NewCounter("test_plain_total", "Plain.")
+	want := "# HELP test_plain_total Plain.\n# TYPE test_plain_total counter\ntest_plain_total 0\n"
+	if got := text(c.vec.vec); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	c.Inc()
+	c.Add(1.5)
+	if got := text(c.vec.vec); !strings.HasSuffix(got, "test_plain_total 2.5\n") {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestFuncs(t *testing.T) {
+	v := 3.0
+	NewGaugeFunc("test_func_gauge", "Gauge.", func() float64 { return v })
+	NewCounterFunc("test_func_total", "Counter.", func() float64 { return 2 * v })
+	v = 4
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"test_func_gauge", "# HELP test_func_gauge Gauge.\n# TYPE test_func_gauge gauge\ntest_func_gauge 4\n"},
+		{"test_func_total", "# HELP test_func_total Counter.\n# TYPE test_func_total counter\ntest_func_total 8\n"},
+	}
+	for _, tt := range tests {
+		Default.mu.Lock()
+		c := Default.collectors[tt.name]
+		Default.mu.Unlock()
+		if got := text(c); got != tt.want {
+			t.Errorf("%v: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestHistogramVec(t *testing.T) {
+	h := NewHistogramVec("test_write_seconds", "Write latency.", []float64{1, 0.1}, "sink")
+	for _, v := range []float64{0.05, 0.1, 0.5, 2} {
+		h.Observe(v, "influx")
+	}
+	want := `# HELP test_write_seconds Write latency.
+# TYPE test_write_seconds histogram
+test_write_seconds_bucket{sink="influx",le="0.1"} 2
+test_write_seconds_bucket{sink="influx",le="1"} 3
+test_write_seconds_bucket{sink="influx",le="+Inf"} 4
+test_write_seconds_sum{sink="influx"} 2.65
+test_write_seconds_count{sink="influx"} 4
+`
+	if got := text(h); got != want {
+		t.Errorf("got\n%v\nwant\n%v", got, want)
+	}
+}
+
+func TestRegistry(t *testing.T) {
+	r := NewRegistry()
+	r.register(&valueFunc{desc: desc{fqName: "b", help: "B.", typ: "gauge"}, f: func() float64 { return 2 }})
+	r.register(&valueFunc{desc: desc{fqName: "a", help: "A.", typ: "gauge"}, f: func() float64 { return 1 }})
+	var buf bytes.Buffer
+	err := r.WriteText(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "# HELP a A.\n# TYPE a gauge\na 1\n# HELP b B.\n# TYPE b gauge\nb 2\n"
+	if got := buf.String(); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	defer func() {
+		if recover() == nil {
+			t.Error("duplicate metric registered")
+		}
+	}()
+	r.register(&valueFunc{desc: desc{fqName: "a", typ: "gauge"}, f: func() float64 { return 0 }})
+}
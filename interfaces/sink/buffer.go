@@ -0,0 +1,653 @@
+package sink
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ncthompson/ThingsWeather/interfaces/metrics"
+	"github.com/ncthompson/ThingsWeather/interfaces/thingsif"
+)
+
+const (
+	// DropOldest discards the oldest buffered observation when full.
+	DropOldest = "oldest"
+	// DropNewest refuses new observations when full.
+	DropNewest = "newest"
+
+	defaultBufferBytes = 64 << 20
+	defaultMaxBackoff  = 300
+	initialBackoff     = time.Second
+
+	// segmentBytes is the size at which a new segment file is started.
+	segmentBytes = 4 << 20
+	// cursorFile holds the replay position.
+	cursorFile = "cursor.json"
+	// deadDir holds the observations the sink rejected permanently.
+	deadDir = "dead"
+)
+
+var bufferPending = metrics.NewGaugeVec("thingsweather_sink_buffered",
+	"Observations waiting in the write-ahead buffer of a sink.", "sink")
+
+// BufferConfig configures the on-disk write-ahead buffer of a sink.
+type BufferConfig struct {
+	// Dir holds one sub-directory per sink.
+	Dir string
+	// MaxBytes caps the buffer size, 64 MiB by default.
+	MaxBytes int64
+	// DropPolicy when full, DropOldest (default) or DropNewest.
+	DropPolicy string
+	// MaxBackoff between replay attempts in seconds, 300 by default.
+	MaxBackoff int
+}
+
+// segment is one append-only file of JSON lines.
+type segment struct {
+	seq     uint64
+	size    int64
+	records int
+}
+
+// cursor is the replay position, the offset of the next observation in
+// the oldest segment.
+type cursor struct {
+	Segment uint64
+	Offset  int64
+}
+
+// deadLetter is an observation the sink rejected, as stored in the
+// dead-letter directory.
+type deadLetter struct {
+	Time        time.Time
+	Error       string
+	Observation json.RawMessage
+}
+
+// Buffer stores observations a sink failed to write in append-only segment
+// files and replays them in order, with exponential backoff, once the sink
+// recovers. Observations the sink rejects permanently are moved to the
+// dead-letter directory instead of holding up the rest. Buffered
+// observations survive restarts; the replay position is saved whenever a
+// segment is finished and on Close, so after a crash part of a segment may
+// be written again.
+type Buffer struct {
+	conf       BufferConfig
+	dir        string
+	name       string
+	sink       Sink
+	segmentMax int64
+
+	mu       sync.Mutex
+	segments []segment
+	// active is the append handle of the last segment, nil until the
+	// next append opens it.
+	active *os.File
+	// head is the offset and headRecords the number of observations
+	// already replayed in the oldest segment.
+	head        int64
+	headRecords int
+	pending     int
+	size        int64
+	next        uint64
+
+	wake chan struct{}
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// NewBuffer wraps s with a write-ahead buffer under conf.Dir/name and
+// starts replaying anything left from a previous run.
+func NewBuffer(s Sink, name string, conf BufferConfig) (*Buffer, error) {
+	if conf.Dir == "" {
+		return nil, errors.New("buffer requires a directory")
+	}
+	if conf.MaxBytes <= 0 {
+		conf.MaxBytes = defaultBufferBytes
+	}
+	if conf.MaxBackoff <= 0 {
+		conf.MaxBackoff = defaultMaxBackoff
+	}
+	switch conf.DropPolicy {
+	case "":
+		conf.DropPolicy = DropOldest
+	case DropOldest, DropNewest:
+	default:
+		return nil, fmt.Errorf("unknown drop policy: %v", conf.DropPolicy)
+	}
+	b := &Buffer{
+		conf:       conf,
+		dir:        filepath.Join(conf.Dir, filepath.Base(name)),
+		name:       name,
+		sink:       s,
+		segmentMax: segmentBytes,
+		next:       1,
+		wake:       make(chan struct{}, 1),
+		done:       make(chan struct{}),
+	}
+	if b.segmentMax > conf.MaxBytes/4 {
+		b.segmentMax = conf.MaxBytes / 4
+	}
+	err := b.load()
+	if err != nil {
+		return nil, err
+	}
+	if a, ok := s.(Acknowledger); ok {
+		a.Acknowledge(b.settle)
+	}
+	if b.pending > 0 {
+		slog.Info("Observations pending from previous run", "sink", name, "pending", b.pending)
+	}
+	bufferPending.Set(float64(b.pending), name)
+	b.wg.Add(1)
+	go b.replay()
+	return b, nil
+}
+
+func (b *Buffer) segmentPath(seq uint64) string {
+	return filepath.Join(b.dir, fmt.Sprintf("%020d.seg", seq))
+}
+
+// load picks up the segments and replay position of a previous run.
+func (b *Buffer) load() error {
+	err := os.MkdirAll(b.dir, 0o750)
+	if err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(b.dir)
+	if err != nil {
+		return err
+	}
+	var legacy []string
+	for _, e := range entries {
+		name := e.Name()
+		switch {
+		case strings.HasSuffix(name, ".tmp"):
+			_ = os.Remove(filepath.Join(b.dir, name))
+		case strings.HasSuffix(name, ".seg"):
+			seq, err := strconv.ParseUint(strings.TrimSuffix(name, ".seg"), 10, 64)
+			if err != nil {
+				continue
+			}
+			b.segments = append(b.segments, segment{seq: seq})
+			if seq >= b.next {
+				b.next = seq + 1
+			}
+		case strings.HasSuffix(name, ".json") && name != cursorFile:
+			// One file per observation, as written by earlier versions.
+			legacy = append(legacy, name)
+		}
+	}
+	sort.Slice(b.segments, func(i, j int) bool {
+		return b.segments[i].seq < b.segments[j].seq
+	})
+
+	var c cursor
+	data, err := os.ReadFile(filepath.Join(b.dir, cursorFile))
+	if err == nil {
+		err = json.Unmarshal(data, &c)
+	}
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("buffer %v: %v", b.name, err)
+	}
+	// Segments before the cursor were replayed but not yet removed.
+	for len(b.segments) > 0 && b.segments[0].seq < c.Segment {
+		_ = os.Remove(b.segmentPath(b.segments[0].seq))
+		b.segments = b.segments[1:]
+	}
+	if len(b.segments) > 0 && b.segments[0].seq == c.Segment {
+		b.head = c.Offset
+	}
+
+	for i := range b.segments {
+		err = b.scan(&b.segments[i], i == len(b.segments)-1)
+		if err != nil {
+			return err
+		}
+	}
+	if len(b.segments) > 0 {
+		if b.head > b.segments[0].size {
+			b.head = b.segments[0].size
+		}
+		// Count the observations before the replay position as done.
+		done, err := countRecords(b.segmentPath(b.segments[0].seq), b.head)
+		if err != nil {
+			return err
+		}
+		b.headRecords = done
+	}
+	b.pending = -b.headRecords
+	b.size = -b.head
+	for _, seg := range b.segments {
+		b.pending += seg.records
+		b.size += seg.size
+	}
+
+	sort.Strings(legacy)
+	for _, name := range legacy {
+		path := filepath.Join(b.dir, name)
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		var line bytes.Buffer
+		err = json.Compact(&line, data)
+		if err == nil {
+			err = b.appendLocked(line.Bytes())
+		}
+		if err != nil {
+			slog.Error("Discarding unreadable buffered observation", "sink", b.name, "file", name, "err", err)
+		}
+		_ = os.Remove(path)
+	}
+	return nil
+}
+
+// scan counts the observations of a segment. A partly written observation
+// at the end of the last segment is cut off.
+func (b *Buffer) scan(seg *segment, last bool) error {
+	path := b.segmentPath(seg.seq)
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) > 0 && last {
+				slog.Warn("Cutting off partly buffered observation", "sink", b.name, "segment", path)
+				return os.Truncate(path, seg.size)
+			}
+			seg.size += int64(len(line))
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		seg.size += int64(len(line))
+		seg.records++
+	}
+}
+
+// countRecords counts the observations in the first size bytes of a
+// segment.
+func countRecords(path string, size int64) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	n := 0
+	r := bufio.NewReader(io.LimitReader(f, size))
+	for {
+		_, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			return n, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		n++
+	}
+}
+
+// Pending returns the number and total size of buffered observations.
+func (b *Buffer) Pending() (int, int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.pending, b.size
+}
+
+// Write passes the observation to the sink, or buffers it when the sink
+// fails or older observations are still waiting to be replayed.
+// Observations the sink rejects permanently go to the dead-letter
+// directory.
+func (b *Buffer) Write(obs *Observation) error {
+	b.mu.Lock()
+	empty := b.pending == 0
+	b.mu.Unlock()
+	if empty {
+		err := b.sink.Write(obs)
+		if err == nil {
+			return nil
+		}
+		if IsPermanent(err) {
+			data, merr := json.Marshal(obs)
+			if merr == nil {
+				b.reject(data, err)
+			}
+			return err
+		}
+		slog.Warn("Sink write failed, buffering", "sink", b.name, "err", err)
+	}
+	return b.push(obs)
+}
+
+func (b *Buffer) push(obs *Observation) error {
+	data, err := json.Marshal(obs)
+	if err != nil {
+		return err
+	}
+	size := int64(len(data)) + 1
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for b.size+size > b.conf.MaxBytes && b.pending > 0 {
+		if b.conf.DropPolicy == DropNewest {
+			return fmt.Errorf("buffer %v full, observation from %v dropped", b.name, obs.Station)
+		}
+		slog.Warn("Buffer full, dropping oldest observation", "sink", b.name)
+		_, n, err := b.headLocked()
+		if err != nil {
+			b.discardHeadLocked(err)
+			continue
+		}
+		b.advanceLocked(n)
+	}
+	err = b.appendLocked(data)
+	if err != nil {
+		return err
+	}
+
+	select {
+	case b.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// appendLocked adds an observation at the end of the last segment, starting
+// a new one when it is full.
+func (b *Buffer) appendLocked(data []byte) error {
+	last := len(b.segments) - 1
+	if last < 0 || b.segments[last].size >= b.segmentMax {
+		if b.active != nil {
+			_ = b.active.Close()
+			b.active = nil
+		}
+		b.segments = append(b.segments, segment{seq: b.next})
+		b.next++
+		last++
+	}
+	seg := &b.segments[last]
+	if b.active == nil {
+		f, err := os.OpenFile(b.segmentPath(seg.seq), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o640)
+		if err != nil {
+			return err
+		}
+		b.active = f
+	}
+	_, err := b.active.Write(append(data, '\n'))
+	if err == nil {
+		err = b.active.Sync()
+	}
+	if err != nil {
+		// Cut off what was written so the segment stays readable.
+		_ = b.active.Truncate(seg.size)
+		return err
+	}
+	seg.size += int64(len(data)) + 1
+	seg.records++
+	b.pending++
+	b.size += int64(len(data)) + 1
+	bufferPending.Set(float64(b.pending), b.name)
+	return nil
+}
+
+// headLocked reads the oldest buffered observation and returns it with its
+// size on disk.
+func (b *Buffer) headLocked() ([]byte, int64, error) {
+	f, err := os.Open(b.segmentPath(b.segments[0].seq))
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+	_, err = f.Seek(b.head, io.SeekStart)
+	if err != nil {
+		return nil, 0, err
+	}
+	line, err := bufio.NewReader(f).ReadBytes('\n')
+	if err != nil {
+		return nil, 0, err
+	}
+	return line[:len(line)-1], int64(len(line)), nil
+}
+
+// advanceLocked moves the replay position past the oldest observation and
+// removes the segments that have been replayed completely.
+func (b *Buffer) advanceLocked(n int64) {
+	b.head += n
+	b.headRecords++
+	b.pending--
+	b.size -= n
+	if b.pending == 0 {
+		b.resetLocked()
+		return
+	}
+	for len(b.segments) > 1 && b.headRecords >= b.segments[0].records {
+		_ = os.Remove(b.segmentPath(b.segments[0].seq))
+		b.segments = b.segments[1:]
+		b.head = 0
+		b.headRecords = 0
+		b.saveCursorLocked()
+	}
+	bufferPending.Set(float64(b.pending), b.name)
+}
+
+// discardHeadLocked drops the rest of an unreadable oldest segment.
+func (b *Buffer) discardHeadLocked(err error) {
+	seg := b.segments[0]
+	lost := seg.records - b.headRecords
+	slog.Error("Discarding unreadable buffer segment", "sink", b.name, "segment", seg.seq,
+		"observations", lost, "err", err)
+	b.pending -= lost
+	b.size -= seg.size - b.head
+	if b.pending <= 0 || len(b.segments) == 1 {
+		b.resetLocked()
+		return
+	}
+	_ = os.Remove(b.segmentPath(seg.seq))
+	b.segments = b.segments[1:]
+	b.head = 0
+	b.headRecords = 0
+	b.saveCursorLocked()
+	bufferPending.Set(float64(b.pending), b.name)
+}
+
+// resetLocked removes all segments once everything has been replayed.
+func (b *Buffer) resetLocked() {
+	if b.active != nil {
+		_ = b.active.Close()
+		b.active = nil
+	}
+	for _, seg := range b.segments {
+		_ = os.Remove(b.segmentPath(seg.seq))
+	}
+	_ = os.Remove(filepath.Join(b.dir, cursorFile))
+	b.segments = nil
+	b.head = 0
+	b.headRecords = 0
+	b.pending = 0
+	b.size = 0
+	bufferPending.Set(0, b.name)
+}
+
+func (b *Buffer) saveCursorLocked() {
+	if len(b.segments) == 0 {
+		return
+	}
+	data, err := json.Marshal(cursor{Segment: b.segments[0].seq, Offset: b.head})
+	if err == nil {
+		path := filepath.Join(b.dir, cursorFile)
+		err = os.WriteFile(path+".tmp", data, 0o640)
+		if err == nil {
+			err = os.Rename(path+".tmp", path)
+		}
+	}
+	if err != nil {
+		slog.Error("Could not save buffer position", "sink", b.name, "err", err)
+	}
+}
+
+// reject moves an observation the sink will never accept to the
+// dead-letter directory, one file of JSON lines per day.
+func (b *Buffer) reject(data []byte, reason error) {
+	slog.Error("Sink rejected observation, moving it to the dead-letter directory", "sink", b.name, "err", reason)
+	now := time.Now().UTC()
+	line, err := json.Marshal(deadLetter{Time: now, Error: reason.Error(), Observation: data})
+	if err == nil {
+		err = os.MkdirAll(filepath.Join(b.dir, deadDir), 0o750)
+	}
+	if err == nil {
+		var f *os.File
+		f, err = os.OpenFile(filepath.Join(b.dir, deadDir, now.Format("2006-01-02")+".jsonl"),
+			os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o640)
+		if err == nil {
+			_, err = f.Write(append(line, '\n'))
+			if err == nil {
+				err = f.Sync()
+			}
+			cerr := f.Close()
+			if err == nil {
+				err = cerr
+			}
+		}
+	}
+	if err != nil {
+		slog.Error("Could not store rejected observation", "sink", b.name, "err", err)
+	}
+}
+
+// settle takes back observations the sink accepted but then failed to
+// store.
+func (b *Buffer) settle(list []*Observation, _ time.Duration, err error) {
+	if err == nil {
+		return
+	}
+	sinkFailures.Add(float64(len(list)), b.name)
+	for _, obs := range list {
+		if IsPermanent(err) {
+			data, merr := json.Marshal(obs)
+			if merr == nil {
+				b.reject(data, err)
+			}
+			continue
+		}
+		perr := b.push(obs)
+		if perr != nil {
+			slog.Error("Could not buffer observation", "sink", b.name, "station", obs.Station, "err", perr)
+		}
+	}
+}
+
+// ack marks the observation read at seq and offset as done, unless it was
+// dropped in the meantime.
+func (b *Buffer) ack(seq uint64, offset, n int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.segments) == 0 || b.segments[0].seq != seq || b.head != offset {
+		return
+	}
+	b.advanceLocked(n)
+}
+
+// replay writes buffered observations oldest first until the buffer is
+// empty, backing off while the sink keeps failing.
+func (b *Buffer) replay() {
+	defer b.wg.Done()
+	backoff := initialBackoff
+	maxBackoff := time.Duration(b.conf.MaxBackoff) * time.Second
+	for {
+		b.mu.Lock()
+		if b.pending == 0 {
+			b.mu.Unlock()
+			select {
+			case <-b.wake:
+				continue
+			case <-b.done:
+				return
+			}
+		}
+		seq, offset := b.segments[0].seq, b.head
+		data, n, err := b.headLocked()
+		if err != nil {
+			b.discardHeadLocked(err)
+			b.mu.Unlock()
+			continue
+		}
+		b.mu.Unlock()
+
+		obs := &Observation{}
+		err = json.Unmarshal(data, obs)
+		if err == nil {
+			err = b.sink.Write(obs)
+		} else {
+			err = Permanent(err)
+		}
+		switch {
+		case IsPermanent(err):
+			b.reject(data, err)
+		case err != nil:
+			slog.Warn("Buffer replay failed", "sink", b.name, "retry", backoff, "err", err)
+			select {
+			case <-time.After(backoff):
+			case <-b.done:
+				return
+			}
+			backoff *= 2
+			if backoff > maxBackoff {
+				backoff = maxBackoff
+			}
+			continue
+		}
+		backoff = initialBackoff
+		b.ack(seq, offset, n)
+	}
+}
+
+// SyncDatabase passes history to the wrapped sink when it supports it.
+func (b *Buffer) SyncDatabase(data []*thingsif.Uplink) error {
+	s, ok := b.sink.(Syncer)
+	if !ok {
+		return nil
+	}
+	return s.SyncDatabase(data)
+}
+
+// Backfill passes history to the wrapped sink when it supports it.
+func (b *Buffer) Backfill(data []*thingsif.Uplink, dryRun bool) (map[string]*SyncCount, error) {
+	s, ok := b.sink.(Backfiller)
+	if !ok {
+		return nil, nil
+	}
+	return s.Backfill(data, dryRun)
+}
+
+// Close stops replaying and closes the sink. Pending observations, and
+// those the sink fails to store while closing, stay on disk for the next
+// run.
+func (b *Buffer) Close() {
+	close(b.done)
+	b.wg.Wait()
+	b.sink.Close()
+	b.mu.Lock()
+	b.saveCursorLocked()
+	if b.active != nil {
+		_ = b.active.Close()
+		b.active = nil
+	}
+	b.mu.Unlock()
+}
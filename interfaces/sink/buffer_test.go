@@ -0,0 +1,398 @@
+package sink
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeSink records the stations written and fails while err returns an
+// error for an observation.
+type fakeSink struct {
+	mu      sync.Mutex
+	err     func(obs *Observation) error
+	written []string
+	closed  bool
+}
+
+func (s *fakeSink) Write(obs *Observation) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		err := s.err(obs)
+		if err != nil {
+			return err
+		}
+	}
+	s.written = append(s.written, obs.Station)
+	return nil
+}
+
+func (s *fakeSink) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+}
+
+func (s *fakeSink) setErr(f func(obs *Observation) error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.err = f
+}
+
+func (s *fakeSink) stations() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string{}, s.written...)
+}
+
+var errDown = errors.New("connection refused")
+
+func down(*Observation) error {
+	return errDown
+}
+
+func obs(station string) *Observation {
+	return &Observation{Station: station, Time: time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)}
+}
+
+// waitPending waits until the buffer holds n observations.
+func waitPending(t *testing.T, b *Buffer, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		pending, _ := b.Pending()
+		if pending == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%v observations pending, want %v", pending, n)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func segments(t *testing.T, dir string) []string {
+	t.Helper()
+	names, err := filepath.Glob(filepath.Join(dir, "*.seg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return names
+}
+
+func TestBufferPassThrough(t *testing.T) {
+	dir := t.TempDir()
+	s := &fakeSink{}
+	b, err := NewBuffer(s, "test", BufferConfig{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, st := range []string{"a", "b"} {
+		err = b.Write(obs(st))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	b.Close()
+	if got := s.stations(); !reflect.DeepEqual(got, []string{"a", "b"}) {
+		t.Errorf("got %v", got)
+	}
+	if !s.closed {
+		t.Error("sink not closed")
+	}
+	if n := segments(t, filepath.Join(dir, "test")); len(n) != 0 {
+		t.Errorf("segments left: %v", n)
+	}
+}
+
+func TestBufferReplayInOrder(t *testing.T) {
+	dir := t.TempDir()
+	s := &fakeSink{err: down}
+	b, err := NewBuffer(s, "test", BufferConfig{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	for _, st := range []string{"a", "b", "c"} {
+		err = b.Write(obs(st))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitPending(t, b, 3)
+	s.setErr(nil)
+	// Buffered observations stay ahead of new ones.
+	err = b.Write(obs("d"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitPending(t, b, 0)
+	if got := s.stations(); !reflect.DeepEqual(got, []string{"a", "b", "c", "d"}) {
+		t.Errorf("got %v", got)
+	}
+	if n := segments(t, filepath.Join(dir, "test")); len(n) != 0 {
+		t.Errorf("segments left: %v", n)
+	}
+}
+
+func TestBufferDeadLetter(t *testing.T) {
+	dir := t.TempDir()
+	s := &fakeSink{err: down}
+	b, err := NewBuffer(s, "test", BufferConfig{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	for _, st := range []string{"a", "bad", "c"} {
+		err = b.Write(obs(st))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.setErr(func(o *Observation) error {
+		if o.Station == "bad" {
+			return Permanent(errors.New("field type conflict"))
+		}
+		return nil
+	})
+	waitPending(t, b, 0)
+	if got := s.stations(); !reflect.DeepEqual(got, []string{"a", "c"}) {
+		t.Errorf("got %v", got)
+	}
+
+	// A direct write rejected by the sink is kept as well.
+	err = b.Write(obs("bad"))
+	if !IsPermanent(err) {
+		t.Errorf("got %v, want a permanent error", err)
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "test", deadDir, "*.jsonl"))
+	if err != nil || len(files) != 1 {
+		t.Fatalf("dead-letter files %v, %v", files, err)
+	}
+	data, err := os.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("got %v dead letters, want 2", len(lines))
+	}
+	var dl deadLetter
+	err = json.Unmarshal([]byte(lines[0]), &dl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var o Observation
+	err = json.Unmarshal(dl.Observation, &o)
+	if err != nil || o.Station != "bad" || dl.Error != "field type conflict" {
+		t.Errorf("got %+v, %+v, %v", dl, o, err)
+	}
+}
+
+func TestBufferSurvivesRestart(t *testing.T) {
+	dir := t.TempDir()
+	s := &fakeSink{err: down}
+	b, err := NewBuffer(s, "test", BufferConfig{Dir: dir, MaxBytes: 2000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want []string
+	for i := 0; i < 10; i++ {
+		st := fmt.Sprintf("s%v", i)
+		want = append(want, st)
+		err = b.Write(obs(st))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	b.Close()
+	if n := segments(t, filepath.Join(dir, "test")); len(n) < 2 {
+		t.Errorf("got %v segments, want several", len(n))
+	}
+
+	s = &fakeSink{}
+	b, err = NewBuffer(s, "test", BufferConfig{Dir: dir, MaxBytes: 2000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	waitPending(t, b, 0)
+	if got := s.stations(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestBufferResumesFromCursor(t *testing.T) {
+	dir := t.TempDir()
+	s := &fakeSink{err: down}
+	b, err := NewBuffer(s, "test", BufferConfig{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, st := range []string{"a", "b", "c"} {
+		err = b.Write(obs(st))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Replay a, then fail again.
+	s.setErr(func(o *Observation) error {
+		if o.Station != "a" {
+			return errDown
+		}
+		return nil
+	})
+	waitPending(t, b, 2)
+	b.Close()
+
+	s = &fakeSink{}
+	b, err = NewBuffer(s, "test", BufferConfig{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	waitPending(t, b, 0)
+	if got := s.stations(); !reflect.DeepEqual(got, []string{"b", "c"}) {
+		t.Errorf("got %v", got)
+	}
+}
+
+func TestBufferFull(t *testing.T) {
+	size := func() int64 {
+		data, _ := json.Marshal(obs("s0"))
+		return int64(len(data)) + 1
+	}()
+	tests := []struct {
+		policy  string
+		want    []string
+		refused int
+	}{
+		{policy: DropOldest, want: []string{"s2", "s3", "s4"}},
+		{policy: DropNewest, want: []string{"s0", "s1", "s2"}, refused: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			s := &fakeSink{err: down}
+			b, err := NewBuffer(s, "test", BufferConfig{Dir: t.TempDir(), MaxBytes: 3 * size, DropPolicy: tt.policy})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer b.Close()
+			refused := 0
+			for i := 0; i < 5; i++ {
+				err = b.Write(obs(fmt.Sprintf("s%v", i)))
+				if err != nil {
+					refused++
+				}
+			}
+			if refused != tt.refused {
+				t.Errorf("%v refused, want %v", refused, tt.refused)
+			}
+			waitPending(t, b, 3)
+			s.setErr(nil)
+			waitPending(t, b, 0)
+			if got := s.stations(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBufferLoad(t *testing.T) {
+	dir := t.TempDir()
+	sub := filepath.Join(dir, "test")
+	err := os.MkdirAll(sub, 0o750)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A file per observation as left by earlier versions.
+	data, _ := json.MarshalIndent(obs("old"), "", "\t")
+	err = os.WriteFile(filepath.Join(sub, fmt.Sprintf("%020d.json", 3)), data, 0o640)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A segment with a partly written observation at the end.
+	line, _ := json.Marshal(obs("seg"))
+	err = os.WriteFile(filepath.Join(sub, fmt.Sprintf("%020d.seg", 1)), append(append(line, '\n'), line[:10]...), 0o640)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(sub, "x.tmp"), nil, 0o640)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &fakeSink{err: down}
+	b, err := NewBuffer(s, "test", BufferConfig{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	waitPending(t, b, 2)
+	s.setErr(nil)
+	waitPending(t, b, 0)
+	if got := s.stations(); !reflect.DeepEqual(got, []string{"seg", "old"}) {
+		t.Errorf("got %v", got)
+	}
+	left, _ := filepath.Glob(filepath.Join(sub, "*"))
+	if len(left) != 0 {
+		t.Errorf("files left: %v", left)
+	}
+}
+
+func TestBufferConfig(t *testing.T) {
+	_, err := NewBuffer(&fakeSink{}, "test", BufferConfig{})
+	if err == nil {
+		t.Error("buffer without directory accepted")
+	}
+	_, err = NewBuffer(&fakeSink{}, "test", BufferConfig{Dir: t.TempDir(), DropPolicy: "random"})
+	if err == nil {
+		t.Error("unknown drop policy accepted")
+	}
+}
+
+// ackSink accepts every observation and reports the outcome later.
+type ackSink struct {
+	fakeSink
+	ack func([]*Observation, time.Duration, error)
+}
+
+func (s *ackSink) Acknowledge(fn func([]*Observation, time.Duration, error)) bool {
+	s.ack = fn
+	return true
+}
+
+func TestBufferSettle(t *testing.T) {
+	dir := t.TempDir()
+	s := &ackSink{}
+	b, err := NewBuffer(s, "test", BufferConfig{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	if s.ack == nil {
+		t.Fatal("buffer did not ask for acknowledgements")
+	}
+	s.setErr(down)
+	s.ack([]*Observation{obs("a"), obs("b")}, time.Second, errDown)
+	s.ack([]*Observation{obs("bad")}, time.Second, Permanent(errors.New("unable to parse")))
+	waitPending(t, b, 2)
+	s.setErr(nil)
+	waitPending(t, b, 0)
+	if got := s.stations(); !reflect.DeepEqual(got, []string{"a", "b"}) {
+		t.Errorf("got %v", got)
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, "test", deadDir, "*.jsonl"))
+	if len(files) != 1 {
+		t.Errorf("got dead-letter files %v", files)
+	}
+}
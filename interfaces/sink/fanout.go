@@ -0,0 +1,344 @@
+package sink
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/ncthompson/ThingsWeather/interfaces/metrics"
+	"github.com/ncthompson/ThingsWeather/interfaces/thingsif"
+)
+
+// queueDepth is the number of observations each sink may fall behind.
+const queueDepth = 256
+
+var (
+	sinkWrites = metrics.NewCounterVec("thingsweather_sink_writes_total",
+		"Observations written per sink.", "sink")
+	sinkFailures = metrics.NewCounterVec("thingsweather_sink_write_failures_total",
+		"Observations a sink failed to write or dropped because its queue was full.", "sink")
+	sinkLatency = metrics.NewHistogramVec("thingsweather_sink_write_duration_seconds",
+		"Time taken by a sink to write an observation, or a batch for sinks that batch writes.", nil, "sink")
+)
+
+type queued struct {
+	name  string
+	sink  Sink
+	queue chan *Observation
+	// deferred is set for sinks that acknowledge writes after Write
+	// returned.
+	deferred bool
+
+	mu        sync.Mutex
+	lastWrite time.Time
+	lastErr   error
+	// writing is when the write in progress started, zero while idle.
+	writing time.Time
+	// stored is the newest uplink time per application the sink stored.
+	// It stops advancing for an application once an observation of it
+	// was lost, so the checkpoint stays before the gap.
+	stored map[string]time.Time
+	held   map[string]bool
+}
+
+// SinkHealth is the state of one sink.
+type SinkHealth struct {
+	Name string
+	// Healthy is false while the last write failed or observations wait
+	// in the write-ahead buffer.
+	Healthy   bool
+	Queued    int
+	Buffered  int
+	LastWrite time.Time
+	LastError string `json:",omitempty"`
+	// Writing is how long the write in progress has taken, empty while
+	// the sink is idle.
+	Writing string `json:",omitempty"`
+}
+
+func (q *queued) run(wg *sync.WaitGroup) {
+	defer wg.Done()
+	for obs := range q.queue {
+		start := time.Now()
+		q.mu.Lock()
+		q.writing = start
+		q.mu.Unlock()
+		err := q.sink.Write(obs)
+		// Deferred writes are timed and counted once the sink acknowledges
+		// them, Write only queued them.
+		if !q.deferred {
+			sinkLatency.Observe(time.Since(start).Seconds(), q.name)
+		}
+		q.mu.Lock()
+		q.writing = time.Time{}
+		q.lastErr = err
+		if err == nil {
+			q.lastWrite = time.Now()
+		}
+		if err != nil || !q.deferred {
+			q.recordLocked(obs, err)
+		}
+		q.mu.Unlock()
+		if err != nil {
+			sinkFailures.Inc(q.name)
+			slog.Error("Sink write failed", "sink", q.name, "err", err)
+			continue
+		}
+		if !q.deferred {
+			sinkWrites.Inc(q.name)
+		}
+	}
+	q.sink.Close()
+}
+
+// settle records the outcome of writes the sink acknowledged later.
+func (q *queued) settle(list []*Observation, took time.Duration, err error) {
+	sinkLatency.Observe(took.Seconds(), q.name)
+	if err != nil {
+		sinkFailures.Add(float64(len(list)), q.name)
+	} else {
+		sinkWrites.Add(float64(len(list)), q.name)
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if err != nil {
+		q.lastErr = err
+	} else {
+		q.lastWrite = time.Now()
+	}
+	for _, obs := range list {
+		q.recordLocked(obs, err)
+	}
+}
+
+// recordLocked advances the stored time of the application of an uplink.
+// Observations rejected permanently would fail again when fetched from
+// history, so they do not hold the checkpoint back.
+func (q *queued) recordLocked(obs *Observation, err error) {
+	if obs.Uplink == nil {
+		return
+	}
+	app := obs.Uplink.AppID
+	if err != nil {
+		if !IsPermanent(err) {
+			q.held[app] = true
+		}
+		return
+	}
+	if !q.held[app] && obs.Time.After(q.stored[app]) {
+		q.stored[app] = obs.Time
+	}
+}
+
+// Fanout writes every observation to several sinks. Each sink runs on its
+// own goroutine, so a slow or failing sink does not hold up the others.
+type Fanout struct {
+	sinks []*queued
+	wg    sync.WaitGroup
+}
+
+// NewFanout opens all configured sinks. Sinks opened before a failure are
+// closed again.
+func NewFanout(confs []Config) (*Fanout, error) {
+	f := &Fanout{}
+	for i := 0; i < len(confs); i++ {
+		conf := confs[i]
+		if conf.Name == "" {
+			conf.Name = fmt.Sprintf("%v-%v", conf.Type, i)
+		}
+		s, err := Open(conf)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		f.Add(conf.Name, s)
+	}
+	return f, nil
+}
+
+// Add starts writing to an already opened sink.
+func (f *Fanout) Add(name string, s Sink) {
+	q := &queued{
+		name:   name,
+		sink:   s,
+		queue:  make(chan *Observation, queueDepth),
+		stored: make(map[string]time.Time),
+		held:   make(map[string]bool),
+	}
+	if a, ok := s.(Acknowledger); ok {
+		q.deferred = a.Acknowledge(q.settle)
+	}
+	f.sinks = append(f.sinks, q)
+	f.wg.Add(1)
+	go q.run(&f.wg)
+}
+
+// Write queues the observation on every sink. It never blocks; sinks that
+// have fallen too far behind drop the observation and are reported.
+func (f *Fanout) Write(obs *Observation) error {
+	var full []string
+	for _, q := range f.sinks {
+		select {
+		case q.queue <- obs:
+		default:
+			sinkFailures.Inc(q.name)
+			full = append(full, q.name)
+			q.mu.Lock()
+			q.recordLocked(obs, errors.New("queue full"))
+			q.mu.Unlock()
+		}
+	}
+	if len(full) > 0 {
+		return fmt.Errorf("sink queue full, dropped observation for %v", full)
+	}
+	return nil
+}
+
+// SyncDatabase backfills history on every sink that supports it.
+func (f *Fanout) SyncDatabase(data []*thingsif.Uplink) error {
+	var failed []string
+	for _, q := range f.sinks {
+		s, ok := q.sink.(Syncer)
+		if !ok {
+			continue
+		}
+		err := s.SyncDatabase(data)
+		if err != nil {
+			slog.Error("Sink sync failed", "sink", q.name, "err", err)
+			failed = append(failed, q.name)
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("sync failed for %v", failed)
+	}
+	return nil
+}
+
+// Backfill fills the gaps in every sink that supports it and returns the
+// counts per sink and device. Sinks are backfilled one after another.
+func (f *Fanout) Backfill(data []*thingsif.Uplink, dryRun bool) (map[string]map[string]*SyncCount, error) {
+	reports := make(map[string]map[string]*SyncCount)
+	var failed []string
+	for _, q := range f.sinks {
+		s, ok := q.sink.(Backfiller)
+		if !ok {
+			continue
+		}
+		counts, err := s.Backfill(data, dryRun)
+		if counts != nil {
+			reports[q.name] = counts
+		}
+		if err != nil {
+			slog.Error("Sink backfill failed", "sink", q.name, "err", err)
+			failed = append(failed, q.name)
+		}
+	}
+	if len(failed) > 0 {
+		return reports, fmt.Errorf("backfill failed for %v", failed)
+	}
+	return reports, nil
+}
+
+// Query reads from the first sink that supports it.
+func (f *Fanout) Query(station string, from, to time.Time, fields []string) ([]Row, error) {
+	for _, q := range f.sinks {
+		s := q.sink
+		if b, ok := s.(*Buffer); ok {
+			s = b.sink
+		}
+		if r, ok := s.(Querier); ok {
+			return r.Query(station, from, to, fields)
+		}
+	}
+	return nil, ErrNoQuerier
+}
+
+// Health reports the state of every sink.
+func (f *Fanout) Health() []SinkHealth {
+	health := make([]SinkHealth, 0, len(f.sinks))
+	for _, q := range f.sinks {
+		h := SinkHealth{Name: q.name, Queued: len(q.queue)}
+		if b, ok := q.sink.(*Buffer); ok {
+			h.Buffered, _ = b.Pending()
+		}
+		q.mu.Lock()
+		h.LastWrite = q.lastWrite
+		if q.lastErr != nil {
+			h.LastError = q.lastErr.Error()
+		}
+		if !q.writing.IsZero() {
+			h.Writing = time.Since(q.writing).Round(time.Second).String()
+		}
+		q.mu.Unlock()
+		h.Healthy = h.LastError == "" && h.Buffered == 0
+		health = append(health, h)
+	}
+	return health
+}
+
+// Stored returns per application the time up to which every sink stored
+// the uplinks it was given, the time a checkpoint may advance to.
+// Applications without such a time in every sink that saw them are left
+// out.
+func (f *Fanout) Stored() map[string]time.Time {
+	stored := make(map[string]time.Time)
+	missing := make(map[string]bool)
+	for _, q := range f.sinks {
+		q.mu.Lock()
+		for app := range q.held {
+			if _, ok := q.stored[app]; !ok {
+				missing[app] = true
+			}
+		}
+		for app, t := range q.stored {
+			if last, ok := stored[app]; !ok || t.Before(last) {
+				stored[app] = t
+			}
+		}
+		q.mu.Unlock()
+	}
+	for app := range missing {
+		delete(stored, app)
+	}
+	return stored
+}
+
+// Busy returns the longest time a sink has spent on the write in
+// progress, zero when all sinks are idle. Write never blocks, so a sink
+// that hangs only shows here.
+func (f *Fanout) Busy() time.Duration {
+	var busy time.Duration
+	for _, q := range f.sinks {
+		q.mu.Lock()
+		if !q.writing.IsZero() && time.Since(q.writing) > busy {
+			busy = time.Since(q.writing)
+		}
+		q.mu.Unlock()
+	}
+	return busy
+}
+
+// Pending returns the number of observations held in the write-ahead
+// buffers of the sinks.
+func (f *Fanout) Pending() int {
+	pending := 0
+	for _, q := range f.sinks {
+		b, ok := q.sink.(*Buffer)
+		if !ok {
+			continue
+		}
+		n, _ := b.Pending()
+		pending += n
+	}
+	return pending
+}
+
+// Close waits for queued observations to be written and closes the sinks.
+func (f *Fanout) Close() {
+	for _, q := range f.sinks {
+		close(q.queue)
+	}
+	f.wg.Wait()
+}
@@ -0,0 +1,182 @@
+package sink
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ncthompson/ThingsWeather/interfaces/metrics"
+	"github.com/ncthompson/ThingsWeather/interfaces/thingsif"
+)
+
+func uplinkObs(app string, minute int) *Observation {
+	t := time.Date(2024, 5, 1, 12, minute, 0, 0, time.UTC)
+	return &Observation{Station: "node", Time: t, Uplink: &thingsif.Uplink{AppID: app, DevID: "node", Time: t}}
+}
+
+func at(minute int) time.Time {
+	return time.Date(2024, 5, 1, 12, minute, 0, 0, time.UTC)
+}
+
+func TestFanoutStored(t *testing.T) {
+	failAt := func(minute int, err error) func(*Observation) error {
+		return func(o *Observation) error {
+			if o.Time.Equal(at(minute)) {
+				return err
+			}
+			return nil
+		}
+	}
+	tests := []struct {
+		name  string
+		sinks []*fakeSink
+		want  map[string]time.Time
+	}{{
+		name:  "all stored",
+		sinks: []*fakeSink{{}, {}},
+		want:  map[string]time.Time{"app": at(3)},
+	}, {
+		name:  "failure holds the checkpoint",
+		sinks: []*fakeSink{{}, {err: failAt(2, errDown)}},
+		want:  map[string]time.Time{"app": at(1)},
+	}, {
+		name:  "nothing stored",
+		sinks: []*fakeSink{{}, {err: down}},
+		want:  map[string]time.Time{},
+	}, {
+		name:  "rejected observations do not hold it",
+		sinks: []*fakeSink{{err: failAt(2, Permanent(errors.New("unable to parse")))}},
+		want:  map[string]time.Time{"app": at(3)},
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &Fanout{}
+			for i, s := range tt.sinks {
+				f.Add(string(rune('a'+i)), s)
+			}
+			for minute := 1; minute <= 3; minute++ {
+				err := f.Write(uplinkObs("app", minute))
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			f.Close()
+			if got := f.Stored(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFanoutStoredHeldApplication(t *testing.T) {
+	f := &Fanout{}
+	f.Add("a", &fakeSink{})
+	f.Add("b", &fakeSink{err: func(o *Observation) error {
+		if o.Uplink.AppID == "held" && o.Time.Equal(at(1)) {
+			return errDown
+		}
+		return nil
+	}})
+	for minute := 1; minute <= 3; minute++ {
+		for _, app := range []string{"held", "free"} {
+			err := f.Write(uplinkObs(app, minute))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	f.Close()
+	// Later uplinks of the held application were stored, but the lost one
+	// must be fetched again, so its checkpoint may not move at all.
+	want := map[string]time.Time{"free": at(3)}
+	if got := f.Stored(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestFanoutStoredAcknowledged(t *testing.T) {
+	s := &ackSink{}
+	f := &Fanout{}
+	f.Add("batched", s)
+	for minute := 1; minute <= 3; minute++ {
+		err := f.Write(uplinkObs("app", minute))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	f.Close()
+	if got := f.Stored(); len(got) != 0 {
+		t.Errorf("got %v before the acknowledgement", got)
+	}
+	s.ack([]*Observation{uplinkObs("app", 1), uplinkObs("app", 2)}, time.Second, nil)
+	s.ack([]*Observation{uplinkObs("app", 3)}, time.Second, errDown)
+	if got := f.Stored(); !got["app"].Equal(at(2)) {
+		t.Errorf("got %v, want up to the acknowledged write", got)
+	}
+	want := map[string]string{
+		"thingsweather_sink_writes_total":                 "2",
+		"thingsweather_sink_write_failures_total":         "1",
+		"thingsweather_sink_write_duration_seconds_count": "2",
+	}
+	for name, v := range want {
+		if got := metric(t, name, "batched"); got != v {
+			t.Errorf("%v: got %v, want %v", name, got, v)
+		}
+	}
+}
+
+// metric returns the exposed value of a sink metric.
+func metric(t *testing.T, name, sink string) string {
+	t.Helper()
+	var buf bytes.Buffer
+	err := metrics.Default.WriteText(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prefix := fmt.Sprintf("%v{sink=%q} ", name, sink)
+	for _, line := range strings.Split(buf.String(), "\n") {
+		if strings.HasPrefix(line, prefix) {
+			return strings.TrimPrefix(line, prefix)
+		}
+	}
+	return ""
+}
+
+func TestFanoutBusy(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{})
+	s := &fakeSink{err: func(*Observation) error {
+		close(started)
+		<-release
+		return nil
+	}}
+	f := &Fanout{}
+	f.Add("slow", s)
+	f.Add("fast", &fakeSink{})
+	if busy := f.Busy(); busy != 0 {
+		t.Errorf("idle sinks busy for %v", busy)
+	}
+	err := f.Write(uplinkObs("app", 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-started
+	time.Sleep(20 * time.Millisecond)
+	if busy := f.Busy(); busy < 20*time.Millisecond {
+		t.Errorf("got busy %v, want the time of the hanging write", busy)
+	}
+	for _, h := range f.Health() {
+		if (h.Writing != "") != (h.Name == "slow") {
+			t.Errorf("%v: got writing %q", h.Name, h.Writing)
+		}
+	}
+	close(release)
+	f.Close()
+	if busy := f.Busy(); busy != 0 {
+		t.Errorf("closed sinks busy for %v", busy)
+	}
+}
@@ -0,0 +1,55 @@
+package sink
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"sync"
+)
+
+// FileConfig configures a sink appending observations as JSON lines.
+type FileConfig struct {
+	Path string
+}
+
+// FileSink appends every observation to a file as one JSON document per
+// line.
+type FileSink struct {
+	mu  sync.Mutex
+	f   *os.File
+	enc *json.Encoder
+}
+
+func init() {
+	Register("file", func(raw json.RawMessage) (Sink, error) {
+		conf := FileConfig{}
+		err := json.Unmarshal(raw, &conf)
+		if err != nil {
+			return nil, err
+		}
+		return NewFileSink(conf)
+	})
+}
+
+func NewFileSink(conf FileConfig) (*FileSink, error) {
+	if conf.Path == "" {
+		return nil, errors.New("file sink requires a path")
+	}
+	f, err := os.OpenFile(conf.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &FileSink{f: f, enc: json.NewEncoder(f)}, nil
+}
+
+func (s *FileSink) Write(obs *Observation) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.enc.Encode(obs)
+}
+
+func (s *FileSink) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.f.Close()
+}
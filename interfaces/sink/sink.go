@@ -0,0 +1,177 @@
+package sink
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ncthompson/ThingsWeather/interfaces/thingsif"
+)
+
+// Observation is the set of measurements a station reported at one time.
+type Observation struct {
+	Station string
+	Time    time.Time
+	Payload *thingsif.Payload
+	// Uplink carries the radio metadata, nil for stations not on LoRa.
+	Uplink *thingsif.Uplink
+	// Link is the packet loss of the station up to this uplink, nil when
+	// not tracked.
+	Link *thingsif.LinkStats `json:",omitempty"`
+}
+
+// FromUplink creates an observation from a decoded uplink.
+func FromUplink(u *thingsif.Uplink) *Observation {
+	return &Observation{
+		Station: u.DevID,
+		Time:    u.Time,
+		Payload: u.Payload,
+		Uplink:  u,
+	}
+}
+
+// Sink stores observations.
+type Sink interface {
+	Write(obs *Observation) error
+	Close()
+}
+
+// PermanentError is returned for an observation a sink will never accept,
+// such as points the database rejects. Retrying it cannot succeed.
+type PermanentError struct {
+	Err error
+}
+
+func (e *PermanentError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *PermanentError) Unwrap() error {
+	return e.Err
+}
+
+// Permanent marks err as a permanent failure. A nil error stays nil.
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &PermanentError{Err: err}
+}
+
+// IsPermanent reports whether err is, or wraps, a permanent failure.
+func IsPermanent(err error) bool {
+	var p *PermanentError
+	return errors.As(err, &p)
+}
+
+// Acknowledger is implemented by sinks that may accept an observation
+// before it is stored, such as a batching writer. Once Acknowledge returned
+// true, a nil error from Write only means the observation was accepted and
+// fn is called with the outcome of every accepted observation and the time
+// taken to write them.
+type Acknowledger interface {
+	Acknowledge(fn func(obs []*Observation, took time.Duration, err error)) bool
+}
+
+// Syncer is implemented by sinks that can backfill history.
+type Syncer interface {
+	SyncDatabase(data []*thingsif.Uplink) error
+}
+
+// SyncCount reports what a backfill found and did for one device.
+type SyncCount struct {
+	// Missing history uplinks, the gaps found in the sink.
+	Missing int
+	// Inserted uplinks, the gaps filled.
+	Inserted int
+	// Skipped uplinks already stored.
+	Skipped int
+	// Invalid uplinks that are never stored.
+	Invalid int
+}
+
+// Backfiller is implemented by sinks that can report the gaps they fill.
+// With dryRun set the gaps are only counted.
+type Backfiller interface {
+	Backfill(data []*thingsif.Uplink, dryRun bool) (map[string]*SyncCount, error)
+}
+
+// Row holds the stored values of a station at one time, keyed by
+// measurement name. Values of a sensor channel are keyed name/channel.
+type Row struct {
+	Time   time.Time          `json:"time"`
+	Values map[string]float64 `json:"values"`
+}
+
+// Querier is implemented by sinks that can read stored observations back.
+type Querier interface {
+	// Query returns the rows of a station between from and to, inclusive,
+	// oldest first, limited to the named fields.
+	Query(station string, from, to time.Time, fields []string) ([]Row, error)
+}
+
+// ErrNoQuerier is returned by Fanout.Query when none of its sinks can read
+// observations back.
+var ErrNoQuerier = errors.New("no sink supports queries")
+
+// Factory creates a sink from its JSON configuration.
+type Factory func(conf json.RawMessage) (Sink, error)
+
+// Config selects a registered sink type and holds its configuration.
+type Config struct {
+	Type   string
+	Name   string
+	Config json.RawMessage
+	// Buffer keeps failed writes on disk for replay when set.
+	Buffer *BufferConfig
+}
+
+var (
+	registryMu sync.Mutex
+	registry   = make(map[string]Factory)
+)
+
+// Register makes a sink type available to Open.
+func Register(typ string, f Factory) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	registry[typ] = f
+}
+
+// Types lists the registered sink types.
+func Types() []string {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	types := make([]string, 0, len(registry))
+	for typ := range registry {
+		types = append(types, typ)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// Open creates the sink described by conf.
+func Open(conf Config) (Sink, error) {
+	registryMu.Lock()
+	f, ok := registry[conf.Type]
+	registryMu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown sink type %q, have %v", conf.Type, Types())
+	}
+	s, err := f(conf.Config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open sink %v: %v", conf.Name, err)
+	}
+	if conf.Buffer != nil {
+		b, err := NewBuffer(s, conf.Name, *conf.Buffer)
+		if err != nil {
+			s.Close()
+			return nil, fmt.Errorf("failed to open buffer of sink %v: %v", conf.Name, err)
+		}
+		return b, nil
+	}
+	return s, nil
+}
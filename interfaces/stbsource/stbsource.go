@@ -7,6 +7,9 @@ import (
 	"strconv"
 	"strings"
 	"time"
+
+	"github.com/ncthompson/ThingsWeather/interfaces/sink"
+	"github.com/ncthompson/ThingsWeather/interfaces/thingsif"
 )
 
 type StbWeather struct {
@@ -54,3 +57,15 @@ func GetStbSource() (*StbWeather, error) {
 	}
 	return &tmp, nil
 }
+
+// Observation converts the measurement for writing to a sink.
+func (s *StbWeather) Observation() *sink.Observation {
+	p := &thingsif.Payload{Valid: true}
+	p.Add(thingsif.MeasTemperature, s.Temperature, "degC")
+	p.Add(thingsif.MeasHumidity, s.Humidity, "%RH")
+	return &sink.Observation{
+		Station: s.Station,
+		Time:    s.Timestamp,
+		Payload: p,
+	}
+}
@@ -0,0 +1,91 @@
+package thingsif
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"sync"
+	"time"
+)
+
+// Checkpoint remembers the time of the last stored uplink per application
+// so the history fetched at startup can resume from there. It is persisted
+// as JSON when a path is given.
+type Checkpoint struct {
+	mu    sync.Mutex
+	path  string
+	last  map[string]time.Time
+	dirty bool
+}
+
+// OpenCheckpoint loads the checkpoint stored at path, if any. An empty path
+// keeps the checkpoint in memory only.
+func OpenCheckpoint(path string) (*Checkpoint, error) {
+	cp := &Checkpoint{
+		path: path,
+		last: make(map[string]time.Time),
+	}
+	if path == "" {
+		return cp, nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return cp, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, &cp.last)
+	if err != nil {
+		return nil, err
+	}
+	return cp, nil
+}
+
+// Get returns the time of the last stored uplink of an application, or the
+// zero time when none is known.
+func (c *Checkpoint) Get(appID string) time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.last[appID]
+}
+
+// Set advances the checkpoint of an application. Older times are ignored.
+func (c *Checkpoint) Set(appID string, t time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if t.After(c.last[appID]) {
+		c.last[appID] = t
+		c.dirty = true
+	}
+}
+
+// Stored advances the checkpoint to the newest of the given uplinks.
+func (c *Checkpoint) Stored(uplinks []*Uplink) {
+	for _, u := range uplinks {
+		c.Set(u.AppID, u.Time)
+	}
+}
+
+// Save writes the checkpoint when it has changed.
+func (c *Checkpoint) Save() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.path == "" || !c.dirty {
+		return nil
+	}
+	data, err := json.MarshalIndent(c.last, "", "\t")
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(c.path+".tmp", data, 0o640)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(c.path+".tmp", c.path)
+	if err != nil {
+		return err
+	}
+	c.dirty = false
+	return nil
+}
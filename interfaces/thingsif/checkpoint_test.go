@@ -0,0 +1,124 @@
+package thingsif
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCheckpointSet(t *testing.T) {
+	cp, err := OpenCheckpoint("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cp.Set("app", t0.Add(time.Minute))
+	cp.Set("app", t0)
+	if got := cp.Get("app"); !got.Equal(t0.Add(time.Minute)) {
+		t.Errorf("got %v, older time moved the checkpoint back", got)
+	}
+	cp.Stored([]*Uplink{
+		{AppID: "app", Time: t0.Add(3 * time.Minute)},
+		{AppID: "app", Time: t0.Add(2 * time.Minute)},
+		{AppID: "other", Time: t0},
+	})
+	if got := cp.Get("app"); !got.Equal(t0.Add(3 * time.Minute)) {
+		t.Errorf("got %v, want the newest uplink", got)
+	}
+	if got := cp.Get("other"); !got.Equal(t0) {
+		t.Errorf("got %v for the other application", got)
+	}
+	if got := cp.Get("unknown"); !got.IsZero() {
+		t.Errorf("got %v for an unknown application", got)
+	}
+	err = cp.Save()
+	if err != nil {
+		t.Errorf("saving in memory: %v", err)
+	}
+}
+
+func TestCheckpointSaveReload(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "checkpoint.json")
+	cp, err := OpenCheckpoint(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := cp.Get("app"); !got.IsZero() {
+		t.Errorf("got %v from a missing file", got)
+	}
+	err = cp.Save()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("unchanged checkpoint was written: %v", err)
+	}
+
+	cp.Set("app", t0)
+	cp.Set("other", t0.Add(time.Hour))
+	err = cp.Save()
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "checkpoint.json" {
+		t.Errorf("got %v, want only the checkpoint file", entries)
+	}
+
+	reloaded, err := OpenCheckpoint(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := reloaded.Get("app"); !got.Equal(t0) {
+		t.Errorf("got %v after reload, want %v", got, t0)
+	}
+	if got := reloaded.Get("other"); !got.Equal(t0.Add(time.Hour)) {
+		t.Errorf("got %v after reload, want %v", got, t0.Add(time.Hour))
+	}
+}
+
+func TestCheckpointSaveKeepsOldOnFailure(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "checkpoint.json")
+	cp, err := OpenCheckpoint(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cp.Set("app", t0)
+	err = cp.Save()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A directory in place of the temporary file makes the write fail
+	// before the checkpoint is replaced.
+	err = os.Mkdir(path+".tmp", 0o750)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cp.Set("app", t0.Add(time.Hour))
+	if err := cp.Save(); err == nil {
+		t.Fatal("save succeeded")
+	}
+	reloaded, err := OpenCheckpoint(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := reloaded.Get("app"); !got.Equal(t0) {
+		t.Errorf("got %v, want the previous checkpoint %v", got, t0)
+	}
+}
+
+func TestOpenCheckpointCorrupt(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "checkpoint.json")
+	err := os.WriteFile(path, []byte("{"), 0o640)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenCheckpoint(path); err == nil {
+		t.Error("corrupt checkpoint opened")
+	}
+}
@@ -0,0 +1,166 @@
+package thingsif
+
+import (
+	"encoding/base64"
+	"fmt"
+	"log/slog"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/ncthompson/ThingsWeather/interfaces/decoder"
+)
+
+// Decoder turns a raw uplink payload into a measurement set.
+type Decoder interface {
+	Decode(raw []byte) (*Payload, error)
+}
+
+// DecoderFunc adapts a function to the Decoder interface.
+type DecoderFunc func(raw []byte) (*Payload, error)
+
+func (f DecoderFunc) Decode(raw []byte) (*Payload, error) {
+	return f(raw)
+}
+
+// DecoderRule selects the named decoder for matching uplinks. Criteria
+// left empty match any uplink; the first matching rule wins.
+type DecoderRule struct {
+	Decoder string
+	// Port is the LoRaWAN FPort, 0 matches any port.
+	Port int
+	// Device is a glob matched against the device ID.
+	Device   string
+	HWSerial string
+}
+
+func (r *DecoderRule) matches(u *Uplink) bool {
+	if r.Port != 0 && r.Port != u.Port {
+		return false
+	}
+	if r.HWSerial != "" && !strings.EqualFold(r.HWSerial, u.HWSerial) {
+		return false
+	}
+	if r.Device != "" {
+		ok, err := path.Match(r.Device, u.DevID)
+		if err != nil || !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// DecoderRegistry decodes raw payloads of uplinks that arrive without
+// payload fields.
+type DecoderRegistry struct {
+	mu       sync.Mutex
+	decoders map[string]Decoder
+	rules    []DecoderRule
+	unknown  map[int]int
+}
+
+func decodeFrame(raw []byte) (*Payload, error) {
+	frame, err := decoder.DecodeFrame(raw)
+	if err != nil {
+		return nil, err
+	}
+	p := &Payload{Valid: true}
+	p.Add(MeasTemperature, frame.Temp, "degC")
+	p.Add(MeasHumidity, frame.Humid, "%RH")
+	p.Add(MeasBattery, frame.Bat, "V")
+	return p, nil
+}
+
+func decodeLPP(raw []byte) (*Payload, error) {
+	readings, err := decoder.DecodeLPP(raw)
+	if err != nil {
+		return nil, err
+	}
+	p := &Payload{Valid: true}
+	for i := 0; i < len(readings); i++ {
+		r := readings[i]
+		m := p.Add(r.Name, r.Value, r.Unit)
+		m.Channel = strconv.Itoa(r.Channel)
+	}
+	return p, nil
+}
+
+// NewDecoderRegistry creates a registry holding the built-in decoders.
+// Without rules the firmware frame decoder is used for every port. A rule
+// naming an unknown decoder is a configuration error.
+func NewDecoderRegistry(rules []DecoderRule) (*DecoderRegistry, error) {
+	if len(rules) == 0 {
+		rules = []DecoderRule{{Decoder: "frame"}}
+	}
+	reg := &DecoderRegistry{
+		decoders: map[string]Decoder{
+			"frame": DecoderFunc(decodeFrame),
+			"lpp":   DecoderFunc(decodeLPP),
+		},
+		rules:   rules,
+		unknown: make(map[int]int),
+	}
+	for i := 0; i < len(rules); i++ {
+		if _, ok := reg.decoders[rules[i].Decoder]; !ok {
+			return nil, fmt.Errorf("unknown decoder %q in rule %v", rules[i].Decoder, i+1)
+		}
+		if _, err := path.Match(rules[i].Device, ""); err != nil {
+			return nil, fmt.Errorf("invalid device pattern %q: %v", rules[i].Device, err)
+		}
+	}
+	return reg, nil
+}
+
+// Decode fills Payload from PayloadRaw when the network server did not
+// decode the payload. Uplinks without a matching decoder are counted
+// per port and left undecoded.
+func (r *DecoderRegistry) Decode(u *Uplink) error {
+	if u.Payload != nil || u.PayloadRaw == "" {
+		return nil
+	}
+	r.mu.Lock()
+	var dec Decoder
+	for i := 0; i < len(r.rules); i++ {
+		if r.rules[i].matches(u) {
+			var ok bool
+			dec, ok = r.decoders[r.rules[i].Decoder]
+			if !ok {
+				r.mu.Unlock()
+				return fmt.Errorf("unknown decoder: %v", r.rules[i].Decoder)
+			}
+			break
+		}
+	}
+	if dec == nil {
+		r.unknown[u.Port]++
+		if r.unknown[u.Port] == 1 {
+			slog.Warn("No decoder for port, further uplinks on this port are only counted", "port", u.Port, "device", u.DevID)
+		}
+		r.mu.Unlock()
+		return nil
+	}
+	r.mu.Unlock()
+
+	raw, err := base64.StdEncoding.DecodeString(u.PayloadRaw)
+	if err != nil {
+		return fmt.Errorf("failed to decode payload from %v: %v", u.DevID, err)
+	}
+	payload, err := dec.Decode(raw)
+	if err != nil {
+		return fmt.Errorf("failed to decode payload from %v: %v", u.DevID, err)
+	}
+	u.Payload = payload
+	return nil
+}
+
+// Unknown returns the number of uplinks seen per port without a decoder.
+func (r *DecoderRegistry) Unknown() map[int]int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	counts := make(map[int]int, len(r.unknown))
+	for port, n := range r.unknown {
+		counts[port] = n
+	}
+	return counts
+}
@@ -0,0 +1,61 @@
+package thingsif
+
+import (
+	"encoding/base64"
+	"testing"
+)
+
+func TestDecoderRules(t *testing.T) {
+	_, err := NewDecoderRegistry([]DecoderRule{{Decoder: "frame"}, {Decoder: "cayenne"}})
+	if err == nil {
+		t.Error("unknown decoder accepted")
+	}
+	_, err = NewDecoderRegistry([]DecoderRule{{Decoder: "lpp", Device: "node["}})
+	if err == nil {
+		t.Error("invalid device pattern accepted")
+	}
+
+	reg, err := NewDecoderRegistry([]DecoderRule{
+		{Decoder: "lpp", Port: 2},
+		{Decoder: "frame", Device: "node*"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	frame := base64.StdEncoding.EncodeToString([]byte{0x07, 0xd0, 0x17, 0x70, 0x0e, 0x74, 0xfe})
+	lpp := base64.StdEncoding.EncodeToString([]byte{0x01, 0x67, 0x00, 0xcd})
+	tests := []struct {
+		name  string
+		u     Uplink
+		first Measurement
+	}{
+		{"frame", Uplink{DevID: "node1", Port: 1, PayloadRaw: frame},
+			Measurement{Name: MeasTemperature, Value: 20, Unit: "degC"}},
+		{"lpp", Uplink{DevID: "other", Port: 2, PayloadRaw: lpp},
+			Measurement{Name: MeasTemperature, Value: 20.5, Unit: "degC", Channel: "1"}},
+		{"unmatched", Uplink{DevID: "other", Port: 3, PayloadRaw: frame}, Measurement{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := reg.Decode(&tt.u)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.first.Name == "" {
+				if tt.u.Payload != nil {
+					t.Errorf("decoded %+v", tt.u.Payload)
+				}
+				return
+			}
+			if tt.u.Payload == nil || len(tt.u.Payload.Measurements) == 0 {
+				t.Fatal("not decoded")
+			}
+			if got := *tt.u.Payload.Measurements[0]; got != tt.first {
+				t.Errorf("got %+v, want %+v", got, tt.first)
+			}
+		})
+	}
+	if got := reg.Unknown(); got[3] != 1 {
+		t.Errorf("got unknown %v", got)
+	}
+}
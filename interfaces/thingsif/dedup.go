@@ -0,0 +1,234 @@
+package thingsif
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// DefaultDedupWindow is the number of frame counters remembered per device.
+const DefaultDedupWindow = 64
+
+// DefaultResetAfter is how long after the highest counter a device must
+// send a lower counter before it counts as restarted.
+const DefaultResetAfter = "10m"
+
+// DedupConfig configures the duplicate uplink filter.
+type DedupConfig struct {
+	// Window is the number of frame counters remembered per device,
+	// DefaultDedupWindow when zero.
+	Window int
+	// ResetAfter is the silence, e.g. 10m, after which a counter at or
+	// below the highest seen means the device restarted.
+	// DefaultResetAfter when empty.
+	ResetAfter string
+	// File persists the filter across restarts when set.
+	File string
+}
+
+// dedupKey identifies a device across applications.
+type dedupKey struct {
+	App string
+	Dev string
+}
+
+// dedupDevice is the filter state of one device. Seen holds the counters of
+// the current reset epoch, Previous those of the epoch before, so late
+// redeliveries from before a reset are still caught. Reset is the time of
+// the first uplink of the current epoch.
+type dedupDevice struct {
+	App         string
+	Dev         string
+	Epoch       int
+	Highest     int
+	HighestTime time.Time
+	Reset       time.Time
+	Seen        map[int]time.Time
+	Previous    map[int]time.Time
+	Duplicates  int
+	Resets      int
+}
+
+// DedupStats reports the filter state of one device.
+type DedupStats struct {
+	Epoch      int
+	Duplicates int
+	Resets     int
+}
+
+// Dedup drops uplinks delivered more than once, for example when several
+// gateways or a TTN redelivery after a reconnect pass on the same frame.
+// Uplinks are keyed on application, device, frame counter and reset epoch;
+// copies of a frame may carry different times. A device restarted when its
+// counter drops by more than the window below the highest seen, or when it
+// sends a counter at or below the highest after ResetAfter of silence.
+type Dedup struct {
+	mu         sync.Mutex
+	window     int
+	resetAfter time.Duration
+	path       string
+	devices    map[dedupKey]*dedupDevice
+	dirty      bool
+}
+
+// OpenDedup loads the filter state stored in conf.File, if any.
+func OpenDedup(conf DedupConfig) (*Dedup, error) {
+	d := &Dedup{
+		window:  conf.Window,
+		path:    conf.File,
+		devices: make(map[dedupKey]*dedupDevice),
+	}
+	if d.window <= 0 {
+		d.window = DefaultDedupWindow
+	}
+	resetAfter := conf.ResetAfter
+	if resetAfter == "" {
+		resetAfter = DefaultResetAfter
+	}
+	var err error
+	d.resetAfter, err = ParseWindow(resetAfter)
+	if err != nil {
+		return nil, err
+	}
+	if d.path == "" {
+		return d, nil
+	}
+	data, err := os.ReadFile(d.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return d, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	list := make([]*dedupDevice, 0)
+	err = json.Unmarshal(data, &list)
+	if err != nil {
+		return nil, err
+	}
+	for _, dev := range list {
+		if dev.Seen == nil {
+			dev.Seen = make(map[int]time.Time)
+		}
+		d.devices[dedupKey{dev.App, dev.Dev}] = dev
+	}
+	return d, nil
+}
+
+// Duplicate records the uplink and reports whether it was seen before.
+func (d *Dedup) Duplicate(u *Uplink) bool {
+	_, dup := d.Check(u)
+	return dup
+}
+
+// Check records the uplink and returns the reset epoch it belongs to and
+// whether it was seen before.
+func (d *Dedup) Check(u *Uplink) (int, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	key := dedupKey{u.AppID, u.DevID}
+	dev, ok := d.devices[key]
+	if !ok {
+		dev = &dedupDevice{
+			App:   u.AppID,
+			Dev:   u.DevID,
+			Reset: u.Time,
+			Seen:  make(map[int]time.Time),
+		}
+		d.devices[key] = dev
+	}
+
+	if dev.Previous != nil && u.Time.Before(dev.Reset) {
+		// Sent before the restart, it belongs to the previous epoch.
+		if _, ok := dev.Previous[u.Counter]; ok {
+			dev.Duplicates++
+			d.dirty = true
+			return dev.Epoch - 1, true
+		}
+		dev.Previous[u.Counter] = u.Time
+		d.dirty = true
+		return dev.Epoch - 1, false
+	}
+
+	if len(dev.Seen) > 0 && d.reset(dev, u) {
+		dev.Epoch++
+		dev.Resets++
+		dev.Previous = dev.Seen
+		dev.Seen = make(map[int]time.Time)
+		dev.Reset = u.Time
+		slog.Info("Counter reset", "device", u.DevID, "counter", u.Counter, "epoch", dev.Epoch)
+	}
+	d.dirty = true
+	if _, ok := dev.Seen[u.Counter]; ok {
+		dev.Duplicates++
+		return dev.Epoch, true
+	}
+	dev.Seen[u.Counter] = u.Time
+	if len(dev.Seen) == 1 || u.Counter > dev.Highest {
+		dev.Highest = u.Counter
+		dev.HighestTime = u.Time
+	}
+	for c := range dev.Seen {
+		if c <= dev.Highest-d.window {
+			delete(dev.Seen, c)
+		}
+	}
+	return dev.Epoch, false
+}
+
+// reset reports whether the uplink is the first after a restart of its
+// device. Redeliveries keep the time they were sent at, so only uplinks
+// sent after the highest counter qualify.
+func (d *Dedup) reset(dev *dedupDevice, u *Uplink) bool {
+	if !u.Time.After(dev.HighestTime) {
+		return false
+	}
+	if u.Counter < dev.Highest-d.window {
+		return true
+	}
+	return u.Counter <= dev.Highest && u.Time.Sub(dev.HighestTime) > d.resetAfter
+}
+
+// Stats returns the filter state per device ID.
+func (d *Dedup) Stats() map[string]DedupStats {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	stats := make(map[string]DedupStats, len(d.devices))
+	for _, dev := range d.devices {
+		s := stats[dev.Dev]
+		s.Epoch = dev.Epoch
+		s.Duplicates += dev.Duplicates
+		s.Resets += dev.Resets
+		stats[dev.Dev] = s
+	}
+	return stats
+}
+
+// Save writes the filter state when it has changed.
+func (d *Dedup) Save() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.path == "" || !d.dirty {
+		return nil
+	}
+	list := make([]*dedupDevice, 0, len(d.devices))
+	for _, dev := range d.devices {
+		list = append(list, dev)
+	}
+	data, err := json.Marshal(list)
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(d.path+".tmp", data, 0o640)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(d.path+".tmp", d.path)
+	if err != nil {
+		return err
+	}
+	d.dirty = false
+	return nil
+}
@@ -0,0 +1,158 @@
+package thingsif
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var t0 = time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+type dedupStep struct {
+	counter int
+	at      time.Duration
+	dup     bool
+	epoch   int
+}
+
+func TestDedupCheck(t *testing.T) {
+	tests := []struct {
+		name   string
+		steps  []dedupStep
+		resets int
+	}{{
+		name: "in order",
+		steps: []dedupStep{
+			{counter: 1, at: 0},
+			{counter: 2, at: time.Minute},
+			{counter: 3, at: 2 * time.Minute},
+		},
+	}, {
+		name: "same frame through two gateways",
+		steps: []dedupStep{
+			{counter: 7, at: 0},
+			{counter: 7, at: 0, dup: true},
+		},
+	}, {
+		name: "retransmission with a later time",
+		steps: []dedupStep{
+			{counter: 7, at: 0},
+			{counter: 7, at: 3 * time.Second, dup: true},
+			{counter: 8, at: time.Minute},
+			{counter: 7, at: time.Minute + time.Second, dup: true},
+		},
+	}, {
+		name: "redelivery after reconnect",
+		steps: []dedupStep{
+			{counter: 1, at: 0},
+			{counter: 2, at: time.Minute},
+			{counter: 3, at: 2 * time.Minute},
+			{counter: 1, at: 0, dup: true},
+			{counter: 2, at: time.Minute, dup: true},
+		},
+	}, {
+		name: "late arrival within window",
+		steps: []dedupStep{
+			{counter: 5, at: 0},
+			{counter: 7, at: 2 * time.Minute},
+			{counter: 6, at: time.Minute},
+			{counter: 6, at: time.Minute, dup: true},
+		},
+	}, {
+		name: "reset by counter drop",
+		steps: []dedupStep{
+			{counter: 500, at: 0},
+			{counter: 0, at: time.Minute, epoch: 1},
+			{counter: 1, at: 2 * time.Minute, epoch: 1},
+			{counter: 0, at: time.Minute, dup: true, epoch: 1},
+		},
+		resets: 1,
+	}, {
+		name: "reset after silence",
+		steps: []dedupStep{
+			{counter: 10, at: 0},
+			{counter: 0, at: time.Hour, epoch: 1},
+			{counter: 1, at: time.Hour + time.Minute, epoch: 1},
+		},
+		resets: 1,
+	}, {
+		name: "redelivery from before a reset",
+		steps: []dedupStep{
+			{counter: 10, at: 0},
+			{counter: 11, at: time.Minute},
+			{counter: 0, at: time.Hour, epoch: 1},
+			{counter: 10, at: 0, dup: true},
+			{counter: 9, at: -time.Minute},
+			{counter: 9, at: -time.Minute, dup: true},
+		},
+		resets: 1,
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, err := OpenDedup(DedupConfig{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			dups := 0
+			for i, s := range tt.steps {
+				u := &Uplink{AppID: "app", DevID: "node", Counter: s.counter, Time: t0.Add(s.at)}
+				epoch, dup := d.Check(u)
+				if dup != s.dup || epoch != s.epoch {
+					t.Errorf("step %v: counter %v got epoch %v duplicate %v, want epoch %v duplicate %v",
+						i, s.counter, epoch, dup, s.epoch, s.dup)
+				}
+				if dup {
+					dups++
+				}
+			}
+			stats := d.Stats()["node"]
+			if stats.Duplicates != dups || stats.Resets != tt.resets {
+				t.Errorf("got %+v, want %v duplicates and %v resets", stats, dups, tt.resets)
+			}
+		})
+	}
+}
+
+func TestDedupWindow(t *testing.T) {
+	d, err := OpenDedup(DedupConfig{Window: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for c := 0; c < 10; c++ {
+		d.Check(&Uplink{DevID: "node", Counter: c, Time: t0.Add(time.Duration(c) * time.Minute)})
+	}
+	dev := d.devices[dedupKey{"", "node"}]
+	if len(dev.Seen) != 4 {
+		t.Errorf("remembered %v counters, want 4", len(dev.Seen))
+	}
+}
+
+func TestDedupSave(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dedup.json")
+	d, err := OpenDedup(DedupConfig{File: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.Check(&Uplink{AppID: "app", DevID: "node", Counter: 3, Time: t0})
+	err = d.Save()
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err = OpenDedup(DedupConfig{File: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !d.Duplicate(&Uplink{AppID: "app", DevID: "node", Counter: 3, Time: t0.Add(time.Second)}) {
+		t.Error("duplicate not detected after reload")
+	}
+	if d.Duplicate(&Uplink{AppID: "other", DevID: "node", Counter: 3, Time: t0}) {
+		t.Error("same device ID in another application counted as duplicate")
+	}
+}
+
+func TestDedupInvalidResetAfter(t *testing.T) {
+	_, err := OpenDedup(DedupConfig{ResetAfter: "soon"})
+	if err == nil {
+		t.Error("invalid ResetAfter accepted")
+	}
+}
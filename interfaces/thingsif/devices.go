@@ -0,0 +1,156 @@
+package thingsif
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"sync"
+	"time"
+)
+
+// DeviceInfo holds what is known about a device from its live uplinks.
+type DeviceInfo struct {
+	DevID    string
+	HWSerial string
+	Port     int
+	LastSeen time.Time
+}
+
+// DeviceRegistry remembers the identity of devices so history rows, which
+// lack it, can be tagged the same as live uplinks. It is persisted as JSON
+// when a path is given.
+type DeviceRegistry struct {
+	mu      sync.Mutex
+	path    string
+	devices map[string]*DeviceInfo
+	dirty   bool
+}
+
+// OpenDeviceRegistry loads the registry stored at path, if any. An empty
+// path keeps the registry in memory only.
+func OpenDeviceRegistry(path string) (*DeviceRegistry, error) {
+	reg := &DeviceRegistry{
+		path:    path,
+		devices: make(map[string]*DeviceInfo),
+	}
+	if path == "" {
+		return reg, nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return reg, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	list := make([]*DeviceInfo, 0)
+	err = json.Unmarshal(data, &list)
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range list {
+		reg.devices[d.DevID] = d
+	}
+	return reg, nil
+}
+
+// Add records a device, for example from static configuration. Known
+// fields are only overwritten by non-empty values.
+func (r *DeviceRegistry) Add(info DeviceInfo) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	d, ok := r.devices[info.DevID]
+	if !ok {
+		d = &DeviceInfo{DevID: info.DevID}
+		r.devices[info.DevID] = d
+	}
+	if info.HWSerial != "" && info.HWSerial != d.HWSerial {
+		d.HWSerial = info.HWSerial
+		r.dirty = true
+	}
+	if info.Port != 0 && info.Port != d.Port {
+		d.Port = info.Port
+		r.dirty = true
+	}
+	if info.LastSeen.After(d.LastSeen) {
+		d.LastSeen = info.LastSeen
+	}
+}
+
+// Update records the identity carried by a live uplink.
+func (r *DeviceRegistry) Update(u *Uplink) {
+	r.Add(DeviceInfo{
+		DevID:    u.DevID,
+		HWSerial: u.HWSerial,
+		Port:     u.Port,
+		LastSeen: u.Time,
+	})
+}
+
+// Get returns what is known about a device.
+func (r *DeviceRegistry) Get(devID string) (DeviceInfo, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	d, ok := r.devices[devID]
+	if !ok {
+		return DeviceInfo{}, false
+	}
+	return *d, true
+}
+
+// Devices returns all known devices.
+func (r *DeviceRegistry) Devices() []DeviceInfo {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	list := make([]DeviceInfo, 0, len(r.devices))
+	for _, d := range r.devices {
+		list = append(list, *d)
+	}
+	return list
+}
+
+// Fill completes the identity of uplinks that lack it, such as history
+// rows.
+func (r *DeviceRegistry) Fill(uplinks []*Uplink) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, u := range uplinks {
+		d, ok := r.devices[u.DevID]
+		if !ok {
+			continue
+		}
+		if u.HWSerial == "" {
+			u.HWSerial = d.HWSerial
+		}
+		if u.Port == 0 {
+			u.Port = d.Port
+		}
+	}
+}
+
+// Save writes the registry when it has changed.
+func (r *DeviceRegistry) Save() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.path == "" || !r.dirty {
+		return nil
+	}
+	list := make([]*DeviceInfo, 0, len(r.devices))
+	for _, d := range r.devices {
+		list = append(list, d)
+	}
+	data, err := json.MarshalIndent(list, "", "\t")
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(r.path+".tmp", data, 0o640)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(r.path+".tmp", r.path)
+	if err != nil {
+		return err
+	}
+	r.dirty = false
+	return nil
+}
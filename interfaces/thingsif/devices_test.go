@@ -0,0 +1,89 @@
+package thingsif
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDeviceRegistryFill(t *testing.T) {
+	tests := []struct {
+		name string
+		in   Uplink
+		want Uplink
+	}{{
+		name: "history row",
+		in:   Uplink{DevID: "node1"},
+		want: Uplink{DevID: "node1", HWSerial: "0004A30B001C0530", Port: 1},
+	}, {
+		name: "known serial kept",
+		in:   Uplink{DevID: "node1", HWSerial: "00000000000000FF"},
+		want: Uplink{DevID: "node1", HWSerial: "00000000000000FF", Port: 1},
+	}, {
+		name: "known port kept",
+		in:   Uplink{DevID: "node1", Port: 2},
+		want: Uplink{DevID: "node1", HWSerial: "0004A30B001C0530", Port: 2},
+	}, {
+		name: "partly known device",
+		in:   Uplink{DevID: "node2"},
+		want: Uplink{DevID: "node2", Port: 3},
+	}, {
+		name: "unknown device",
+		in:   Uplink{DevID: "node3"},
+		want: Uplink{DevID: "node3"},
+	}}
+	reg, err := OpenDeviceRegistry("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg.Update(&Uplink{DevID: "node1", HWSerial: "0004A30B001C0530", Port: 1, Time: t0})
+	reg.Add(DeviceInfo{DevID: "node2", Port: 3})
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u := tt.in
+			reg.Fill([]*Uplink{&u})
+			if !reflect.DeepEqual(u, tt.want) {
+				t.Errorf("got %+v, want %+v", u, tt.want)
+			}
+		})
+	}
+}
+
+func TestDeviceRegistryAdd(t *testing.T) {
+	reg, err := OpenDeviceRegistry("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg.Add(DeviceInfo{DevID: "node1", HWSerial: "0004A30B001C0530", Port: 1, LastSeen: t0.Add(time.Hour)})
+	reg.Add(DeviceInfo{DevID: "node1", LastSeen: t0})
+	want := DeviceInfo{DevID: "node1", HWSerial: "0004A30B001C0530", Port: 1, LastSeen: t0.Add(time.Hour)}
+	if got, ok := reg.Get("node1"); !ok || got != want {
+		t.Errorf("got %+v, want %+v, empty fields must not overwrite", got, want)
+	}
+	if _, ok := reg.Get("node2"); ok {
+		t.Error("unknown device found")
+	}
+}
+
+func TestDeviceRegistrySaveReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "devices.json")
+	reg, err := OpenDeviceRegistry(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg.Update(&Uplink{DevID: "node1", HWSerial: "0004A30B001C0530", Port: 1, Time: t0})
+	err = reg.Save()
+	if err != nil {
+		t.Fatal(err)
+	}
+	reloaded, err := OpenDeviceRegistry(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := &Uplink{DevID: "node1"}
+	reloaded.Fill([]*Uplink{u})
+	if u.HWSerial != "0004A30B001C0530" || u.Port != 1 {
+		t.Errorf("got %+v after reload", u)
+	}
+}
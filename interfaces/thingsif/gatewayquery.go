@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"strings"
 )
 
 /*
@@ -25,19 +26,22 @@ type HandMeta struct {
 	AppID string `json:"app_id"`
 }
 
-func getHTTPBody(url, password string) ([]byte, error) {
+// getHTTPBody fetches url, sending auth as the Authorization header when
+// it is not empty.
+func getHTTPBody(url, auth string) ([]byte, error) {
 	client := &http.Client{}
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get body: %v", err)
 	}
-	if password != "" {
-		req.Header.Add("Authorization", "key "+password)
+	if auth != "" {
+		req.Header.Add("Authorization", auth)
 	}
 	resp, err := client.Do(req)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get body: %v", err)
 	}
+	defer resp.Body.Close()
 	if resp.StatusCode != 200 {
 		return nil, fmt.Errorf("failed to get body: %v", resp.Status)
 	}
@@ -71,3 +75,18 @@ func (mq *MQTTCli) getBroker() (string, error) {
 	}
 	return "", errors.New("application username not found")
 }
+
+// brokerURL returns the configured broker, falling back to discovery.
+func (mq *MQTTCli) brokerURL() (string, error) {
+	if mq.conf.Broker == "" {
+		url, err := mq.getBroker()
+		if err != nil {
+			return "", err
+		}
+		return "tcp://" + url, nil
+	}
+	if !strings.Contains(mq.conf.Broker, "://") {
+		return "tcp://" + mq.conf.Broker, nil
+	}
+	return mq.conf.Broker, nil
+}
@@ -0,0 +1,217 @@
+package thingsif
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DefaultLossWindows are the windows packet loss is aggregated over.
+var DefaultLossWindows = []string{"1h", "24h"}
+
+// LossConfig configures the packet loss statistics.
+type LossConfig struct {
+	// Windows to aggregate loss over, e.g. 1h or 7d. DefaultLossWindows
+	// when empty.
+	Windows []string
+}
+
+// Gap is a range of frame counters that were not received.
+type Gap struct {
+	// Epoch is the restart count of the node the counters belong to.
+	Epoch int
+	First int
+	Last  int
+	// Time of the uplink that revealed the gap.
+	Time time.Time
+}
+
+// Missed is the number of frames in the gap.
+func (g Gap) Missed() int {
+	return g.Last - g.First + 1
+}
+
+// WindowLoss is the packet loss of a device over one window.
+type WindowLoss struct {
+	Window   string
+	Received int
+	Missed   int
+	// Loss is the fraction of frames missed.
+	Loss float64
+}
+
+// LinkStats is the packet loss of a device after an uplink.
+type LinkStats struct {
+	Epoch   int
+	Windows []WindowLoss
+	// Gaps revealed by this uplink.
+	Gaps []Gap
+}
+
+type lossWindow struct {
+	name string
+	d    time.Duration
+}
+
+// lossDevice holds the frames a device sent within the longest window.
+type lossDevice struct {
+	epoch    int
+	last     int
+	lastTime time.Time
+	received []time.Time
+	gaps     []Gap
+}
+
+// LossTracker computes per device packet loss and missed frame counter
+// ranges from the uplink frame counters. Restarts are taken from the reset
+// epoch of the duplicate filter: a new epoch starts counting from zero, a
+// counter at or below the last one within an epoch is a late arrival.
+type LossTracker struct {
+	mu      sync.Mutex
+	windows []lossWindow
+	longest time.Duration
+	devices map[dedupKey]*lossDevice
+}
+
+// NewLossTracker creates a tracker aggregating over the configured windows.
+func NewLossTracker(conf LossConfig) (*LossTracker, error) {
+	names := conf.Windows
+	if len(names) == 0 {
+		names = DefaultLossWindows
+	}
+	t := &LossTracker{devices: make(map[dedupKey]*lossDevice)}
+	for _, name := range names {
+		d, err := ParseWindow(name)
+		if err != nil {
+			return nil, err
+		}
+		if d <= 0 {
+			return nil, fmt.Errorf("invalid loss window %q", name)
+		}
+		t.windows = append(t.windows, lossWindow{name: name, d: d})
+		if d > t.longest {
+			t.longest = d
+		}
+	}
+	return t, nil
+}
+
+// Update records an uplink of the given reset epoch and returns the loss of
+// its device.
+func (t *LossTracker) Update(u *Uplink, epoch int) *LinkStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	key := dedupKey{u.AppID, u.DevID}
+	dev, ok := t.devices[key]
+	if !ok {
+		dev = &lossDevice{epoch: epoch, last: u.Counter, lastTime: u.Time}
+		t.devices[key] = dev
+		dev.received = append(dev.received, u.Time)
+		return t.stats(dev, u.Time, nil)
+	}
+
+	var changed []Gap
+	switch {
+	case epoch > dev.epoch:
+		// Restarted node, the frames of the new epoch before this one are
+		// missed.
+		dev.epoch = epoch
+		if u.Counter > 0 {
+			g := Gap{Epoch: epoch, First: 0, Last: u.Counter - 1, Time: u.Time}
+			dev.gaps = append(dev.gaps, g)
+			changed = append(changed, g)
+		}
+		dev.last = u.Counter
+		dev.lastTime = u.Time
+	case epoch == dev.epoch && u.Counter > dev.last:
+		if u.Counter > dev.last+1 {
+			g := Gap{Epoch: epoch, First: dev.last + 1, Last: u.Counter - 1, Time: u.Time}
+			dev.gaps = append(dev.gaps, g)
+			changed = append(changed, g)
+		}
+		dev.last = u.Counter
+		dev.lastTime = u.Time
+	default:
+		// Late arrival, it fills part of a gap.
+		dev.fill(u.Counter, epoch)
+	}
+	i := sort.Search(len(dev.received), func(i int) bool {
+		return dev.received[i].After(u.Time)
+	})
+	dev.received = append(dev.received, time.Time{})
+	copy(dev.received[i+1:], dev.received[i:])
+	dev.received[i] = u.Time
+	dev.prune(dev.lastTime.Add(-t.longest))
+	return t.stats(dev, dev.lastTime, changed)
+}
+
+// fill removes a late counter from the gap of its epoch it is in.
+func (dev *lossDevice) fill(counter, epoch int) {
+	for i, g := range dev.gaps {
+		if g.Epoch != epoch || counter < g.First || counter > g.Last {
+			continue
+		}
+		var split []Gap
+		if counter > g.First {
+			split = append(split, Gap{Epoch: g.Epoch, First: g.First, Last: counter - 1, Time: g.Time})
+		}
+		if counter < g.Last {
+			split = append(split, Gap{Epoch: g.Epoch, First: counter + 1, Last: g.Last, Time: g.Time})
+		}
+		gaps := append([]Gap{}, dev.gaps[:i]...)
+		gaps = append(gaps, split...)
+		dev.gaps = append(gaps, dev.gaps[i+1:]...)
+		return
+	}
+}
+
+// prune forgets frames and gaps from before start.
+func (dev *lossDevice) prune(start time.Time) {
+	i := sort.Search(len(dev.received), func(i int) bool {
+		return !dev.received[i].Before(start)
+	})
+	dev.received = dev.received[i:]
+	gaps := dev.gaps[:0]
+	for _, g := range dev.gaps {
+		if !g.Time.Before(start) {
+			gaps = append(gaps, g)
+		}
+	}
+	dev.gaps = gaps
+}
+
+func (t *LossTracker) stats(dev *lossDevice, now time.Time, changed []Gap) *LinkStats {
+	s := &LinkStats{Epoch: dev.epoch, Gaps: changed}
+	for _, w := range t.windows {
+		start := now.Add(-w.d)
+		wl := WindowLoss{Window: w.name}
+		for _, r := range dev.received {
+			if r.After(start) {
+				wl.Received++
+			}
+		}
+		for _, g := range dev.gaps {
+			if g.Time.After(start) {
+				wl.Missed += g.Missed()
+			}
+		}
+		if wl.Received+wl.Missed > 0 {
+			wl.Loss = float64(wl.Missed) / float64(wl.Received+wl.Missed)
+		}
+		s.Windows = append(s.Windows, wl)
+	}
+	return s
+}
+
+// Gaps returns the missed frame counter ranges of a device within the
+// longest window.
+func (t *LossTracker) Gaps(appID, devID string) []Gap {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	dev, ok := t.devices[dedupKey{appID, devID}]
+	if !ok {
+		return nil
+	}
+	return append([]Gap{}, dev.gaps...)
+}
@@ -0,0 +1,130 @@
+package thingsif
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+type lossStep struct {
+	counter int
+	epoch   int
+	at      time.Duration
+}
+
+func TestLossTracker(t *testing.T) {
+	tests := []struct {
+		name     string
+		steps    []lossStep
+		gaps     []Gap
+		received int
+		missed   int
+	}{{
+		name: "no loss",
+		steps: []lossStep{
+			{counter: 1}, {counter: 2, at: time.Minute}, {counter: 3, at: 2 * time.Minute},
+		},
+		received: 3,
+	}, {
+		name: "gap",
+		steps: []lossStep{
+			{counter: 1}, {counter: 5, at: 4 * time.Minute},
+		},
+		gaps:     []Gap{{First: 2, Last: 4, Time: t0.Add(4 * time.Minute)}},
+		received: 2,
+		missed:   3,
+	}, {
+		name: "late arrival fills a gap",
+		steps: []lossStep{
+			{counter: 1}, {counter: 5, at: 4 * time.Minute}, {counter: 3, at: 2 * time.Minute},
+		},
+		gaps: []Gap{
+			{First: 2, Last: 2, Time: t0.Add(4 * time.Minute)},
+			{First: 4, Last: 4, Time: t0.Add(4 * time.Minute)},
+		},
+		received: 3,
+		missed:   2,
+	}, {
+		name: "copy of an old counter sent later",
+		steps: []lossStep{
+			{counter: 5000}, {counter: 5001, at: time.Minute}, {counter: 5000, at: 2 * time.Minute},
+		},
+		received: 3,
+	}, {
+		name: "restart",
+		steps: []lossStep{
+			{counter: 100}, {counter: 101, at: time.Minute}, {counter: 2, epoch: 1, at: time.Hour},
+		},
+		gaps:     []Gap{{Epoch: 1, First: 0, Last: 1, Time: t0.Add(time.Hour)}},
+		received: 3,
+		missed:   2,
+	}, {
+		name: "late arrival from before a restart",
+		steps: []lossStep{
+			{counter: 10}, {counter: 12, at: 2 * time.Minute}, {counter: 0, epoch: 1, at: time.Hour},
+			{counter: 11, at: time.Minute},
+		},
+		received: 4,
+	}, {
+		name: "gaps outside the window are forgotten",
+		steps: []lossStep{
+			{counter: 1}, {counter: 3, at: time.Minute}, {counter: 4, at: 25 * time.Hour},
+		},
+		received: 1,
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lt, err := NewLossTracker(LossConfig{Windows: []string{"24h"}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var stats *LinkStats
+			for _, s := range tt.steps {
+				u := &Uplink{AppID: "app", DevID: "node", Counter: s.counter, Time: t0.Add(s.at)}
+				stats = lt.Update(u, s.epoch)
+			}
+			gaps := lt.Gaps("app", "node")
+			if len(gaps) == 0 {
+				gaps = nil
+			}
+			if !reflect.DeepEqual(gaps, tt.gaps) {
+				t.Errorf("got gaps %+v, want %+v", gaps, tt.gaps)
+			}
+			w := stats.Windows[0]
+			if w.Received != tt.received || w.Missed != tt.missed {
+				t.Errorf("got %v received %v missed, want %v and %v", w.Received, w.Missed, tt.received, tt.missed)
+			}
+		})
+	}
+}
+
+func TestLossTrackerGapsReported(t *testing.T) {
+	lt, err := NewLossTracker(LossConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lt.Update(&Uplink{DevID: "node", Counter: 1, Time: t0}, 0)
+	stats := lt.Update(&Uplink{DevID: "node", Counter: 4, Time: t0.Add(time.Minute)}, 0)
+	if len(stats.Gaps) != 1 || stats.Gaps[0].Missed() != 2 {
+		t.Errorf("got gaps %+v, want one of 2 frames", stats.Gaps)
+	}
+	if len(stats.Windows) != len(DefaultLossWindows) {
+		t.Errorf("got %v windows, want %v", len(stats.Windows), len(DefaultLossWindows))
+	}
+	if loss := stats.Windows[0].Loss; loss != 0.5 {
+		t.Errorf("got loss %v, want 0.5", loss)
+	}
+	stats = lt.Update(&Uplink{DevID: "node", Counter: 5, Time: t0.Add(2 * time.Minute)}, 0)
+	if len(stats.Gaps) != 0 {
+		t.Errorf("gaps reported again: %+v", stats.Gaps)
+	}
+}
+
+func TestLossTrackerInvalidWindow(t *testing.T) {
+	for _, w := range []string{"", "0h", "later"} {
+		_, err := NewLossTracker(LossConfig{Windows: []string{w}})
+		if err == nil {
+			t.Errorf("window %q accepted", w)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package thingsif
+
+import (
+	"sort"
+)
+
+// Measurement names written by the original fixed payload, kept so
+// existing dashboards continue to work.
+const (
+	MeasTemperature = "temperature"
+	MeasHumidity    = "humidity"
+	MeasBattery     = "battery-voltage"
+	MeasRain        = "rain-tips"
+	MeasPressure    = "pressure"
+)
+
+// Measurement is a single sensor value.
+type Measurement struct {
+	Name  string  `json:"name"`
+	Value float64 `json:"value"`
+	Unit  string  `json:"unit,omitempty"`
+	// Quality flags a suspect value, empty when the value is good.
+	Quality string `json:"quality,omitempty"`
+	// Channel distinguishes sensors of the same kind on one node.
+	Channel string `json:"channel,omitempty"`
+}
+
+// Payload is the decoded measurement set of an uplink.
+type Payload struct {
+	Valid        bool           `json:"valid"`
+	Measurements []*Measurement `json:"measurements"`
+}
+
+// Add appends a measurement to the payload.
+func (p *Payload) Add(name string, value float64, unit string) *Measurement {
+	m := &Measurement{Name: name, Value: value, Unit: unit}
+	p.Measurements = append(p.Measurements, m)
+	return m
+}
+
+// Get returns the first measurement with the given name, or nil.
+func (p *Payload) Get(name string) *Measurement {
+	for i := 0; i < len(p.Measurements); i++ {
+		if p.Measurements[i].Name == name {
+			return p.Measurements[i]
+		}
+	}
+	return nil
+}
+
+// legacyFields maps the keys of the original payload decoder onto
+// measurement names and units.
+var legacyFields = map[string][2]string{
+	"bat":  {MeasBattery, "V"},
+	"humd": {MeasHumidity, "%RH"},
+	"temp": {MeasTemperature, "degC"},
+	"rain": {MeasRain, "tips"},
+	"pres": {MeasPressure, "hPa"},
+}
+
+// PayloadFields holds the object produced by a payload decoder running on
+// the network server.
+type PayloadFields map[string]interface{}
+
+// Payload converts the decoded fields into a measurement set. The keys of
+// the original decoder keep their measurement names, any other numeric
+// field is stored under its own key. Only payloads marked valid by the
+// decoder count as valid.
+func (f PayloadFields) Payload() *Payload {
+	p := &Payload{}
+	p.Valid, _ = f["valid"].(bool)
+	keys := make([]string, 0, len(f))
+	for k := range f {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		value, ok := f[k].(float64)
+		if !ok {
+			continue
+		}
+		if legacy, ok := legacyFields[k]; ok {
+			p.Add(legacy[0], value, legacy[1])
+		} else {
+			p.Add(k, value, "")
+		}
+	}
+	return p
+}
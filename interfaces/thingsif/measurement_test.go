@@ -0,0 +1,64 @@
+package thingsif
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestPayloadFields(t *testing.T) {
+	tests := []struct {
+		name   string
+		fields string
+		want   Payload
+	}{
+		{
+			name:   "legacy",
+			fields: `{"valid": true, "temp": 20.5, "humd": 60, "bat": 3.7}`,
+			want: Payload{Valid: true, Measurements: []*Measurement{
+				{Name: MeasBattery, Value: 3.7, Unit: "V"},
+				{Name: MeasHumidity, Value: 60, Unit: "%RH"},
+				{Name: MeasTemperature, Value: 20.5, Unit: "degC"},
+			}},
+		},
+		{
+			name:   "missing valid",
+			fields: `{"temp": 20.5}`,
+			want: Payload{Measurements: []*Measurement{
+				{Name: MeasTemperature, Value: 20.5, Unit: "degC"},
+			}},
+		},
+		{
+			name:   "invalid",
+			fields: `{"valid": false, "temp": 0}`,
+			want: Payload{Measurements: []*Measurement{
+				{Name: MeasTemperature, Value: 0, Unit: "degC"},
+			}},
+		},
+		{
+			name:   "valid not a bool",
+			fields: `{"valid": "yes", "wind": 3}`,
+			want:   Payload{Measurements: []*Measurement{{Name: "wind", Value: 3}}},
+		},
+		{
+			name:   "other fields",
+			fields: `{"valid": true, "pres": 1013, "uv": 4, "label": "roof"}`,
+			want: Payload{Valid: true, Measurements: []*Measurement{
+				{Name: MeasPressure, Value: 1013, Unit: "hPa"},
+				{Name: "uv", Value: 4},
+			}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var f PayloadFields
+			err := json.Unmarshal([]byte(tt.fields), &f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := f.Payload(); !reflect.DeepEqual(*got, tt.want) {
+				t.Errorf("got %+v, want %+v", *got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,246 @@
+package thingsif
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// OverflowBlock holds up the MQTT client until there is room.
+	OverflowBlock = "block"
+	// OverflowDropOldest discards the oldest queued message.
+	OverflowDropOldest = "drop-oldest"
+	// OverflowSpill writes messages to disk until the queue drains.
+	OverflowSpill = "spill"
+
+	defaultQueueSize = 1024
+)
+
+// ErrClosed is returned once the client is closed and its queue drained.
+var ErrClosed = errors.New("mqtt client closed")
+
+// QueueConfig configures the queue between MQTT receipt and processing.
+type QueueConfig struct {
+	// Size of the in-memory queue, 1024 messages by default.
+	Size int
+	// Overflow policy when the queue is full: OverflowBlock (default),
+	// OverflowDropOldest or OverflowSpill.
+	Overflow string
+	// SpillDir holds the messages spilled to disk. Spilled messages are
+	// picked up again after a restart.
+	SpillDir string
+}
+
+// QueueStats reports the state of the queue.
+type QueueStats struct {
+	Capacity int
+	// Depth is the number of messages in memory.
+	Depth int
+	// Spilled is the number of messages on disk.
+	Spilled int
+	// Dropped messages since start.
+	Dropped uint64
+}
+
+// Received is a message as received from the broker.
+type Received struct {
+	Topic   string
+	Payload []byte
+	// Time the message was received.
+	Time time.Time
+}
+
+// queue is a bounded FIFO of received messages. Once a message has been
+// spilled, later messages are spilled too until the disk is drained, so
+// order is kept.
+type queue struct {
+	conf QueueConfig
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	buf     []Received
+	spilled []string
+	next    uint64
+	dropped uint64
+	closed  bool
+}
+
+func newQueue(conf QueueConfig) (*queue, error) {
+	if conf.Size <= 0 {
+		conf.Size = defaultQueueSize
+	}
+	switch conf.Overflow {
+	case "":
+		conf.Overflow = OverflowBlock
+	case OverflowBlock, OverflowDropOldest:
+	case OverflowSpill:
+		if conf.SpillDir == "" {
+			return nil, errors.New("spill queue requires SpillDir")
+		}
+	default:
+		return nil, fmt.Errorf("unknown queue overflow policy: %v", conf.Overflow)
+	}
+	q := &queue{conf: conf}
+	q.cond = sync.NewCond(&q.mu)
+	if conf.Overflow == OverflowSpill {
+		err := q.load()
+		if err != nil {
+			return nil, err
+		}
+		if len(q.spilled) > 0 {
+			slog.Info("Queue spilled by previous run", "messages", len(q.spilled))
+		}
+	}
+	return q, nil
+}
+
+// load picks up the messages spilled by a previous run.
+func (q *queue) load() error {
+	err := os.MkdirAll(q.conf.SpillDir, 0o750)
+	if err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(q.conf.SpillDir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		name := e.Name()
+		if strings.HasSuffix(name, ".tmp") {
+			_ = os.Remove(filepath.Join(q.conf.SpillDir, name))
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, ".json"), 10, 64)
+		if err != nil || !strings.HasSuffix(name, ".json") {
+			continue
+		}
+		q.spilled = append(q.spilled, name)
+		if seq >= q.next {
+			q.next = seq + 1
+		}
+	}
+	sort.Strings(q.spilled)
+	return nil
+}
+
+// push queues a message, applying the overflow policy when full.
+func (q *queue) push(m Received) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		q.dropped++
+		return
+	}
+	switch q.conf.Overflow {
+	case OverflowBlock:
+		for len(q.buf) >= q.conf.Size && !q.closed {
+			q.cond.Wait()
+		}
+		if q.closed {
+			q.dropped++
+			return
+		}
+	case OverflowDropOldest:
+		if len(q.buf) >= q.conf.Size {
+			q.buf = q.buf[1:]
+			q.dropped++
+		}
+	case OverflowSpill:
+		if len(q.spilled) > 0 || len(q.buf) >= q.conf.Size {
+			err := q.spillLocked(m)
+			if err != nil {
+				slog.Error("Queue spill failed, message dropped", "err", err)
+				q.dropped++
+			}
+			q.cond.Broadcast()
+			return
+		}
+	}
+	q.buf = append(q.buf, m)
+	q.cond.Broadcast()
+}
+
+func (q *queue) spillLocked(m Received) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%020d.json", q.next)
+	q.next++
+	path := filepath.Join(q.conf.SpillDir, name)
+	err = os.WriteFile(path+".tmp", data, 0o640)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(path+".tmp", path)
+	if err != nil {
+		return err
+	}
+	q.spilled = append(q.spilled, name)
+	return nil
+}
+
+// pop blocks until a message is available. It returns false once the
+// queue is closed and empty in memory; spilled messages stay on disk.
+func (q *queue) pop() (Received, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for {
+		if len(q.buf) > 0 {
+			m := q.buf[0]
+			q.buf[0] = Received{}
+			q.buf = q.buf[1:]
+			q.cond.Broadcast()
+			return m, true
+		}
+		if q.closed {
+			return Received{}, false
+		}
+		if len(q.spilled) > 0 {
+			name := q.spilled[0]
+			q.spilled = q.spilled[1:]
+			path := filepath.Join(q.conf.SpillDir, name)
+			data, err := os.ReadFile(path)
+			m := Received{}
+			if err == nil {
+				err = json.Unmarshal(data, &m)
+			}
+			_ = os.Remove(path)
+			if err != nil {
+				slog.Warn("Queue discarding unreadable message", "file", name, "err", err)
+				q.dropped++
+				continue
+			}
+			return m, true
+		}
+		q.cond.Wait()
+	}
+}
+
+// close wakes blocked callers. Messages still in memory can be popped.
+func (q *queue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.closed = true
+	q.cond.Broadcast()
+}
+
+func (q *queue) stats() QueueStats {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return QueueStats{
+		Capacity: q.conf.Size,
+		Depth:    len(q.buf),
+		Spilled:  len(q.spilled),
+		Dropped:  q.dropped,
+	}
+}
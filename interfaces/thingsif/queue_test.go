@@ -0,0 +1,176 @@
+package thingsif
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func msg(i int) Received {
+	return Received{Topic: fmt.Sprintf("m%v", i), Payload: []byte("{}"), Time: t0}
+}
+
+// drain pops n messages and returns their topics.
+func drain(t *testing.T, q *queue, n int) []string {
+	t.Helper()
+	var topics []string
+	for i := 0; i < n; i++ {
+		m, ok := q.pop()
+		if !ok {
+			t.Fatalf("queue closed after %v messages", i)
+		}
+		topics = append(topics, m.Topic)
+	}
+	return topics
+}
+
+func TestQueueConfig(t *testing.T) {
+	tests := []struct {
+		conf QueueConfig
+		ok   bool
+	}{
+		{QueueConfig{}, true},
+		{QueueConfig{Overflow: OverflowDropOldest}, true},
+		{QueueConfig{Overflow: OverflowSpill}, false},
+		{QueueConfig{Overflow: OverflowSpill, SpillDir: t.TempDir()}, true},
+		{QueueConfig{Overflow: "drop-newest"}, false},
+	}
+	for _, tt := range tests {
+		q, err := newQueue(tt.conf)
+		if (err == nil) != tt.ok {
+			t.Errorf("%+v: got %v", tt.conf, err)
+			continue
+		}
+		if err == nil && q.stats().Capacity != defaultQueueSize && tt.conf.Size == 0 {
+			t.Errorf("%+v: got capacity %v", tt.conf, q.stats().Capacity)
+		}
+	}
+}
+
+func TestQueueDropOldest(t *testing.T) {
+	q, err := newQueue(QueueConfig{Size: 3, Overflow: OverflowDropOldest})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		q.push(msg(i))
+	}
+	if s := q.stats(); s.Depth != 3 || s.Dropped != 2 {
+		t.Errorf("got stats %+v", s)
+	}
+	if got := drain(t, q, 3); !reflect.DeepEqual(got, []string{"m2", "m3", "m4"}) {
+		t.Errorf("got %v", got)
+	}
+}
+
+func TestQueueBlock(t *testing.T) {
+	q, err := newQueue(QueueConfig{Size: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.push(msg(0))
+	q.push(msg(1))
+	pushed := make(chan struct{})
+	go func() {
+		q.push(msg(2))
+		close(pushed)
+	}()
+	select {
+	case <-pushed:
+		t.Fatal("push did not block on a full queue")
+	case <-time.After(20 * time.Millisecond):
+	}
+	if got := drain(t, q, 1); got[0] != "m0" {
+		t.Errorf("got %v", got)
+	}
+	<-pushed
+	if got := drain(t, q, 2); !reflect.DeepEqual(got, []string{"m1", "m2"}) {
+		t.Errorf("got %v", got)
+	}
+	if s := q.stats(); s.Dropped != 0 {
+		t.Errorf("got stats %+v", s)
+	}
+}
+
+func TestQueueClose(t *testing.T) {
+	q, err := newQueue(QueueConfig{Size: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.push(msg(0))
+	blocked := make(chan struct{})
+	go func() {
+		q.push(msg(1))
+		close(blocked)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	q.close()
+	<-blocked
+	// What is in memory can still be popped.
+	if got := drain(t, q, 1); got[0] != "m0" {
+		t.Errorf("got %v", got)
+	}
+	if _, ok := q.pop(); ok {
+		t.Error("pop after close and drain")
+	}
+	q.push(msg(2))
+	if s := q.stats(); s.Dropped != 2 {
+		t.Errorf("got stats %+v, want the blocked and late pushes dropped", s)
+	}
+}
+
+func TestQueueSpill(t *testing.T) {
+	dir := t.TempDir()
+	conf := QueueConfig{Size: 2, Overflow: OverflowSpill, SpillDir: dir}
+	q, err := newQueue(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 4; i++ {
+		q.push(msg(i))
+	}
+	if got := drain(t, q, 1); got[0] != "m0" {
+		t.Errorf("got %v", got)
+	}
+	// Room in memory, but later messages follow the spilled ones.
+	q.push(msg(4))
+	if s := q.stats(); s.Depth != 1 || s.Spilled != 3 {
+		t.Errorf("got stats %+v", s)
+	}
+	if got := drain(t, q, 2); !reflect.DeepEqual(got, []string{"m1", "m2"}) {
+		t.Errorf("got %v", got)
+	}
+	q.close()
+
+	// A restart picks up what is left on disk, ignoring partial writes.
+	err = os.WriteFile(filepath.Join(dir, "x.tmp"), []byte("{"), 0o640)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(dir, fmt.Sprintf("%020d.json", 90)), []byte("{"), 0o640)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q, err = newQueue(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := q.stats(); s.Spilled != 3 {
+		t.Errorf("got stats %+v", s)
+	}
+	q.push(msg(5))
+	got := drain(t, q, 3)
+	if !reflect.DeepEqual(got, []string{"m3", "m4", "m5"}) {
+		t.Errorf("got %v", got)
+	}
+	if s := q.stats(); s.Dropped != 1 || s.Spilled != 0 {
+		t.Errorf("got stats %+v, want the unreadable message dropped", s)
+	}
+	left, _ := filepath.Glob(filepath.Join(dir, "*"))
+	if len(left) != 0 {
+		t.Errorf("files left: %v", left)
+	}
+}
@@ -1,50 +1,253 @@
 package thingsif
 
 import (
+	"bufio"
+	"bytes"
 	"encoding/json"
 	"fmt"
+	"log/slog"
+	"math"
+	"net/url"
+	"strconv"
+	"strings"
 	"time"
 )
 
+// DefaultHistoryWindow is the retention of the TTN v2 storage integration.
+const DefaultHistoryWindow = 7 * 24 * time.Hour
+
+// DbMessage is a row from the storage integration. Sensor fields are nil
+// when the node did not report them.
 type DbMessage struct {
-	Time  string  `json:"time"`
-	DevID string  `json:"device_id"`
-	Raw   string  `json:"raw"`
-	Bat   float64 `json:"bat"`
-	Humid float64 `json:"humd"`
-	Temp  float64 `json:"temp"`
-	Rain  float64 `json:"rain,omitempty"`
-	Pres  float64 `json:"pres,omitempty"`
-	Valid bool    `json:"valid"`
+	Time  string   `json:"time"`
+	DevID string   `json:"device_id"`
+	Raw   string   `json:"raw"`
+	Bat   *float64 `json:"bat"`
+	Humid *float64 `json:"humd"`
+	Temp  *float64 `json:"temp"`
+	Rain  *float64 `json:"rain,omitempty"`
+	Pres  *float64 `json:"pres,omitempty"`
+	Valid bool     `json:"valid"`
 }
 
 type DbList struct {
 	List []*DbMessage
 }
 
-func (mq *MQTTCli) GetLast7days() ([]DbMessage, error) {
-	fmt.Printf("Start get %v\n", time.Now())
-	url := "https://" + mq.conf.Username + ".data.thethingsnetwork.org/api/v2/query?last=7d"
+// ParseWindow parses a history window such as 36h or 7d.
+func ParseWindow(s string) (time.Duration, error) {
+	if strings.HasSuffix(s, "d") {
+		days, err := strconv.ParseFloat(strings.TrimSuffix(s, "d"), 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid window %q", s)
+		}
+		return time.Duration(days * float64(24*time.Hour)), nil
+	}
+	return time.ParseDuration(s)
+}
+
+// History fetches stored uplinks from the storage integration.
+type History struct {
+	conf     MQTTConfig
+	decoders *DecoderRegistry
+}
+
+// NewHistory creates a history client for the storage integration of the
+// application in conf, decoding raw payloads with the configured decoders.
+func NewHistory(conf MQTTConfig) (*History, error) {
+	decoders, err := NewDecoderRegistry(conf.Decoders)
+	if err != nil {
+		return nil, err
+	}
+	return &History{conf: conf, decoders: decoders}, nil
+}
+
+// Retention of the storage integration.
+func (h *History) Retention() (time.Duration, error) {
+	if h.conf.StorageRetention == "" {
+		return DefaultHistoryWindow, nil
+	}
+	return ParseWindow(h.conf.StorageRetention)
+}
+
+// Window is the configured history window capped by the retention.
+func (h *History) Window() (time.Duration, error) {
+	retention, err := h.Retention()
+	if err != nil {
+		return 0, err
+	}
+	if h.conf.HistoryWindow == "" {
+		return retention, nil
+	}
+	window, err := ParseWindow(h.conf.HistoryWindow)
+	if err != nil {
+		return 0, err
+	}
+	if window > retention {
+		window = retention
+	}
+	return window, nil
+}
+
+// AppID is the application of the configured credentials.
+func (h *History) AppID() string {
+	return strings.SplitN(h.conf.Username, "@", 2)[0]
+}
+
+// Fetch returns the uplinks of an application stored between from and to,
+// inclusive.
+func (h *History) Fetch(appID string, from, to time.Time) ([]*Uplink, error) {
+	slog.Info("Get history", "app", appID, "from", from.Format(time.RFC3339), "to", to.Format(time.RFC3339))
+	var uplinks []*Uplink
+	var err error
+	if h.conf.Format == FormatV3 {
+		uplinks, err = h.fetchV3(appID, from, to)
+	} else {
+		uplinks, err = h.fetchV2(appID, from, to)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get history: %v", err)
+	}
+	for _, u := range uplinks {
+		err = h.decoders.Decode(u)
+		if err != nil {
+			slog.Warn("History decode failed", "err", err)
+		}
+	}
+	slog.Info("History fetched", "uplinks", len(uplinks))
+	return uplinks, nil
+}
+
+// AppID is the application the client receives uplinks for.
+func (mq *MQTTCli) AppID() string {
+	return mq.history().AppID()
+}
+
+func (mq *MQTTCli) history() *History {
+	return &History{conf: mq.conf, decoders: mq.Decoders}
+}
+
+// GetHistory fetches the uplinks stored by the storage integration since
+// the given time, limited to the history window. A zero since requests
+// the whole window.
+func (mq *MQTTCli) GetHistory(since time.Time) ([]*Uplink, error) {
+	h := mq.history()
+	window, err := h.Window()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	start := now.Add(-window)
+	if since.After(start) {
+		start = since
+	}
+	return h.Fetch(h.AppID(), start, now)
+}
+
+func (h *History) fetchV2(appID string, from, to time.Time) ([]*Uplink, error) {
+	// The v2 API only takes a window relative to now, in whole minutes.
+	last := int(math.Ceil(time.Since(from).Minutes()))
+	base := h.conf.StorageURL
+	if base == "" {
+		base = "https://" + appID + ".data.thethingsnetwork.org"
+	}
+	url := fmt.Sprintf("%v/api/v2/query?last=%vm", strings.TrimSuffix(base, "/"), last)
 	messages := make([]DbMessage, 0)
-	body, err := getHTTPBody(url, mq.conf.Password)
+	body, err := getHTTPBody(url, "key "+h.conf.Password)
 	if err != nil {
-		return messages, fmt.Errorf("failed to get history: %v", err)
+		return nil, err
 	}
 	err = json.Unmarshal(body, &messages)
 	if err != nil {
-		return messages, fmt.Errorf("failed to get history: %v", err)
+		return nil, err
 	}
-	fmt.Printf("done get %v\n", time.Now())
-	return messages, nil
+	uplinks := make([]*Uplink, 0, len(messages))
+	for i := 0; i < len(messages); i++ {
+		u, err := messages[i].Uplink(appID)
+		if err != nil {
+			return nil, err
+		}
+		if !u.Time.Before(from) && !u.Time.After(to) {
+			uplinks = append(uplinks, u)
+		}
+	}
+	return uplinks, nil
+}
+
+func (h *History) fetchV3(appID string, from, to time.Time) ([]*Uplink, error) {
+	if h.conf.StorageURL == "" {
+		return nil, fmt.Errorf("the v3 storage integration needs StorageURL")
+	}
+	params := url.Values{}
+	params.Set("after", from.UTC().Format(time.RFC3339Nano))
+	params.Set("before", to.UTC().Format(time.RFC3339Nano))
+	endpoint := fmt.Sprintf("%v/api/v3/as/applications/%v/packages/storage/uplink_message?%v",
+		strings.TrimSuffix(h.conf.StorageURL, "/"), url.PathEscape(appID), params.Encode())
+	body, err := getHTTPBody(endpoint, "Bearer "+h.conf.Password)
+	if err != nil {
+		return nil, err
+	}
+	// The response is one {"result": ...} object per line.
+	uplinks := make([]*Uplink, 0)
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		row := struct {
+			Result *MessageV3 `json:"result"`
+		}{}
+		err = json.Unmarshal(line, &row)
+		if err != nil {
+			return nil, err
+		}
+		if row.Result == nil {
+			continue
+		}
+		u, err := row.Result.Uplink()
+		if err != nil {
+			return nil, err
+		}
+		uplinks = append(uplinks, u)
+	}
+	return uplinks, scanner.Err()
+}
+
+// Uplink converts the row into an uplink without radio metadata.
+func (d *DbMessage) Uplink(appID string) (*Uplink, error) {
+	ts, err := time.Parse(time.RFC3339Nano, d.Time)
+	if err != nil {
+		return nil, err
+	}
+	return &Uplink{
+		AppID:      appID,
+		DevID:      d.DevID,
+		PayloadRaw: d.Raw,
+		Payload:    d.Payload(),
+		Time:       ts,
+	}, nil
 }
 
-func (d *DbMessage) NodeEntry() *NodeEntry {
-	return &NodeEntry{
-		Bat:   d.Bat,
-		Humid: d.Humid,
-		Temp:  d.Temp,
-		Rain:  d.Rain,
-		Pres:  d.Pres,
-		Valid: d.Valid,
+// Payload returns the reported fields as a measurement set.
+func (d *DbMessage) Payload() *Payload {
+	p := &Payload{Valid: d.Valid}
+	fields := []struct {
+		value *float64
+		key   string
+	}{
+		{d.Temp, "temp"},
+		{d.Humid, "humd"},
+		{d.Bat, "bat"},
+		{d.Rain, "rain"},
+		{d.Pres, "pres"},
+	}
+	for _, f := range fields {
+		if f.value != nil {
+			legacy := legacyFields[f.key]
+			p.Add(legacy[0], *f.value, legacy[1])
+		}
 	}
+	return p
 }
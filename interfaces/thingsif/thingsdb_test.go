@@ -0,0 +1,76 @@
+package thingsif
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseWindow(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    time.Duration
+		wantErr bool
+	}{
+		{in: "36h", want: 36 * time.Hour},
+		{in: "90m", want: 90 * time.Minute},
+		{in: "7d", want: 7 * 24 * time.Hour},
+		{in: "1.5d", want: 36 * time.Hour},
+		{in: "0d", want: 0},
+		{in: "d", wantErr: true},
+		{in: "sevend", wantErr: true},
+		{in: "7", wantErr: true},
+		{in: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := ParseWindow(tt.in)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("got %v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHistoryWindow(t *testing.T) {
+	tests := []struct {
+		name      string
+		retention string
+		window    string
+		want      time.Duration
+		wantErr   bool
+	}{
+		{name: "defaults", want: DefaultHistoryWindow},
+		{name: "retention only", retention: "2d", want: 48 * time.Hour},
+		{name: "shorter window", retention: "7d", window: "36h", want: 36 * time.Hour},
+		{name: "capped by retention", retention: "1d", window: "7d", want: 24 * time.Hour},
+		{name: "invalid window", window: "week", wantErr: true},
+		{name: "invalid retention", retention: "xd", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &History{conf: MQTTConfig{StorageRetention: tt.retention, HistoryWindow: tt.window}}
+			got, err := h.Window()
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("got %v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -1,10 +1,13 @@
 package thingsif
 
 import (
-	"encoding/json"
 	"fmt"
-	"log"
+	"log/slog"
+	"net/url"
 	"os"
+	"strings"
+	"sync/atomic"
+	"time"
 
 	MQTT "github.com/eclipse/paho.mqtt.golang"
 )
@@ -27,7 +30,7 @@ type GwMetadata struct {
 }
 
 type Message struct {
-	PayloadFields *NodeEntry    `json:"payload_fields"`
+	PayloadFields PayloadFields `json:"payload_fields"`
 	DevID         string        `json:"dev_id"`
 	AppID         string        `json:"app_id"`
 	HWSerial      string        `json:"hardware_serial"`
@@ -46,15 +49,6 @@ type NodeMetadata struct {
 	Gateways   []*GwMetadata `json:"gateways"`
 }
 
-type NodeEntry struct {
-	Bat   float64 `json:"bat"`
-	Humid float64 `json:"humd"`
-	Temp  float64 `json:"temp"`
-	Rain  float64 `json:"rain,omitempty"`
-	Pres  float64 `json:"pres,omitempty"`
-	Valid bool    `json:"valid"`
-}
-
 /*
    Configuration
 */
@@ -62,47 +56,128 @@ type NodeEntry struct {
 type MQTTConfig struct {
 	Username string
 	Password string
+	// Format of the uplink messages published by the application,
+	// either FormatV2 or FormatV3. Defaults to FormatV2.
+	Format string
+	// Broker URL, e.g. tcp://localhost:1883. When empty the broker is
+	// looked up through the TTN discovery service.
+	Broker string
+	// Topic filter to subscribe to. Defaults to the uplink topic of Format.
+	Topic        string
+	ClientID     string
+	QoS          byte
+	CleanSession *bool
+	// TLS settings for mqtts:// and ssl:// brokers.
+	TLS *TLSConfig
+	// Decoders used for uplinks without payload fields.
+	Decoders []DecoderRule
+	// StorageURL of the storage integration. Required for FormatV3, e.g.
+	// https://eu1.cloud.thethings.network; FormatV2 defaults to the
+	// application's data.thethingsnetwork.org host.
+	StorageURL string
+	// StorageRetention of the storage integration, 7d by default.
+	StorageRetention string
+	// HistoryWindow limits how far back history is fetched at startup,
+	// e.g. 36h or 7d. Defaults to StorageRetention.
+	HistoryWindow string
+	// Queue between MQTT receipt and processing.
+	Queue QueueConfig
+}
+
+// LogValue keeps the access key, also when part of the broker URL, out of
+// logs.
+func (c MQTTConfig) LogValue() slog.Value {
+	type plain MQTTConfig
+	if c.Password != "" {
+		c.Password = "REDACTED"
+	}
+	if c.Broker != "" {
+		c.Broker = redactURL(c.Broker)
+	}
+	return slog.AnyValue(plain(c))
 }
 
 type MQTTCli struct {
-	choke chan [2]string
-	cli   MQTT.Client
-	conf  MQTTConfig
+	queue   *queue
+	cli     MQTT.Client
+	conf    MQTTConfig
+	certErr atomic.Value
+	// Decoders for raw payloads.
+	Decoders *DecoderRegistry
 }
 
 func NewClient(conf MQTTConfig) (*MQTTCli, error) {
 	mqtt := &MQTTCli{}
 	mqtt.conf = conf
 
+	topic := "+/devices/+/up"
+	switch conf.Format {
+	case "", FormatV2:
+	case FormatV3:
+		topic = "v3/+/devices/+/up"
+	default:
+		return nil, fmt.Errorf("unknown message format: %v", conf.Format)
+	}
+	if conf.Topic != "" {
+		topic = conf.Topic
+	}
+	if conf.QoS > 2 {
+		return nil, fmt.Errorf("invalid QoS: %v", conf.QoS)
+	}
+	decoders, err := NewDecoderRegistry(conf.Decoders)
+	if err != nil {
+		return nil, err
+	}
+	mqtt.Decoders = decoders
+	mqtt.queue, err = newQueue(conf.Queue)
+	if err != nil {
+		return nil, err
+	}
+
 	opts := MQTT.NewClientOptions()
 	opts.SetAutoReconnect(true)
 	opts.SetMessageChannelDepth(1024)
 	opts.SetPassword(conf.Password)
 	opts.SetUsername(conf.Username)
-	url, err := mqtt.getBroker()
+	opts.SetClientID(conf.ClientID)
+	if conf.CleanSession != nil {
+		opts.SetCleanSession(*conf.CleanSession)
+	}
+	broker, err := mqtt.brokerURL()
 	if err != nil {
 		return nil, err
 	}
-	broker := "tcp://" + url
+	slog.Info("MQTT broker", "url", redactURL(broker))
 	opts.AddBroker(broker)
-	topic := "+/devices/+/up"
+	tlsConf, err := mqtt.brokerTLS(broker)
+	if err != nil {
+		return nil, err
+	}
+	if tlsConf != nil {
+		opts.SetTLSConfig(tlsConf)
+		if !strings.HasPrefix(broker, "wss://") {
+			opts.SetCustomOpenConnectionFn(mqtt.dialTLS(tlsConf))
+		}
+	}
 	opts.OnConnect = func(c MQTT.Client) {
-		log.Print("Connected\n")
-		if token := c.Subscribe(topic, byte(0), nil); token.Wait() && token.Error() != nil {
-			fmt.Println(token.Error())
+		slog.Info("MQTT connected")
+		if token := c.Subscribe(topic, conf.QoS, nil); token.Wait() && token.Error() != nil {
+			slog.Error("MQTT subscribe failed", "topic", topic, "err", token.Error())
 			os.Exit(1)
 		}
-		log.Print("Subscribed\n")
+		slog.Info("MQTT subscribed", "topic", topic)
 	}
-	mqtt.choke = make(chan [2]string)
+	opts.SetConnectionLostHandler(func(c MQTT.Client, err error) {
+		slog.Warn("MQTT connection lost", "err", err)
+	})
 	opts.SetDefaultPublishHandler(func(client MQTT.Client, msg MQTT.Message) {
-		mqtt.choke <- [2]string{msg.Topic(), string(msg.Payload())}
+		mqtt.queue.push(Received{Topic: msg.Topic(), Payload: msg.Payload(), Time: time.Now()})
 	})
 
 	mqttCli := MQTT.NewClient(opts)
 
 	if token := mqttCli.Connect(); token.Wait() && token.Error() != nil {
-		return nil, token.Error()
+		return nil, mqtt.connectError(token.Error())
 	}
 	mqtt.cli = mqttCli
 
@@ -110,30 +185,64 @@ func NewClient(conf MQTTConfig) (*MQTTCli, error) {
 }
 
 /*
- * Blocks on incoming message.
+ * Blocks on incoming message. Returns ErrClosed once the client is closed.
  */
-func (mq *MQTTCli) WaitForData() (*Message, error) {
-	msg := &Message{}
-	incoming := <-mq.choke
-	err := json.Unmarshal([]byte(incoming[1]), msg)
+func (mq *MQTTCli) WaitForData() (*Uplink, error) {
+	msg, err := mq.Receive()
+	if err != nil {
+		return nil, err
+	}
+	return mq.Decode(msg)
+}
+
+// Receive blocks until a message arrives. Once the client is closed it
+// returns the messages still queued in memory, then ErrClosed.
+func (mq *MQTTCli) Receive() (*Received, error) {
+	incoming, ok := mq.queue.pop()
+	if !ok {
+		return nil, ErrClosed
+	}
+	return &incoming, nil
+}
 
+// Decode parses a received message and decodes its raw payload.
+func (mq *MQTTCli) Decode(msg *Received) (*Uplink, error) {
+	uplink, err := ParseUplink(mq.conf.Format, msg.Payload)
 	if err != nil {
 		return nil, err
 	}
-	return msg, nil
+	uplink.Received = msg.Time
+	return uplink, mq.Decoders.Decode(uplink)
 }
 
-/*
- *
- */
+// Connected reports whether the client has a working broker connection.
+func (mq *MQTTCli) Connected() bool {
+	return mq.cli != nil && mq.cli.IsConnectionOpen()
+}
+
+// redactURL hides the password in a URL with credentials.
+func redactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "unparsable URL"
+	}
+	return u.Redacted()
+}
+
+// PrintGatways logs the gateways that heard an uplink at debug level.
 func PrintGatways(gw []*GwMetadata) {
 	for i := 0; i < len(gw); i++ {
-		log.Printf("GW Id:%v\n", gw[i].GtwID)
-		log.Printf("RSSI:%v\n", gw[i].RSSI)
-		log.Printf("SNR:%v\n", gw[i].SNR)
+		slog.Debug("gateway", "gtw_id", gw[i].GtwID, "rssi", gw[i].RSSI, "snr", gw[i].SNR, "channel", gw[i].Channel)
 	}
 }
 
+// QueueStats reports the state of the receive queue.
+func (mq *MQTTCli) QueueStats() QueueStats {
+	return mq.queue.stats()
+}
+
+// Close stops receiving. Messages already queued can still be received.
 func (mq *MQTTCli) Close() {
 	mq.cli.Disconnect(1000)
+	mq.queue.close()
 }
@@ -0,0 +1,141 @@
+package thingsif
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+/*
+   The Things Stack (v3) payload structure
+*/
+
+type V3AppIDs struct {
+	AppID string `json:"application_id"`
+}
+
+type V3DeviceIDs struct {
+	DevID   string   `json:"device_id"`
+	AppIDs  V3AppIDs `json:"application_ids"`
+	DevEUI  string   `json:"dev_eui"`
+	JoinEUI string   `json:"join_eui"`
+	DevAddr string   `json:"dev_addr"`
+}
+
+type V3GatewayIDs struct {
+	GtwID string `json:"gateway_id"`
+	EUI   string `json:"eui"`
+}
+
+type V3Location struct {
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+	Altitude  float64 `json:"altitude"`
+}
+
+type V3RxMetadata struct {
+	GatewayIDs   V3GatewayIDs `json:"gateway_ids"`
+	Time         string       `json:"time"`
+	Timestamp    int64        `json:"timestamp"`
+	RSSI         float64      `json:"rssi"`
+	ChannelRSSI  float64      `json:"channel_rssi"`
+	SNR          float64      `json:"snr"`
+	ChannelIndex int          `json:"channel_index"`
+	RFChain      int          `json:"rf_chain"`
+	Location     *V3Location  `json:"location"`
+}
+
+type V3LoRaDataRate struct {
+	Bandwidth       int    `json:"bandwidth"`
+	SpreadingFactor int    `json:"spreading_factor"`
+	CodingRate      string `json:"coding_rate"`
+}
+
+type V3DataRate struct {
+	LoRa *V3LoRaDataRate `json:"lora"`
+}
+
+type V3TxSettings struct {
+	DataRate   V3DataRate `json:"data_rate"`
+	CodingRate string     `json:"coding_rate"`
+	Frequency  string     `json:"frequency"`
+}
+
+type V3UplinkMessage struct {
+	FPort          int             `json:"f_port"`
+	FCnt           int             `json:"f_cnt"`
+	FrmPayload     string          `json:"frm_payload"`
+	DecodedPayload PayloadFields   `json:"decoded_payload"`
+	RxMetadata     []*V3RxMetadata `json:"rx_metadata"`
+	Settings       V3TxSettings    `json:"settings"`
+	ReceivedAt     string          `json:"received_at"`
+}
+
+type MessageV3 struct {
+	EndDeviceIDs  V3DeviceIDs      `json:"end_device_ids"`
+	ReceivedAt    string           `json:"received_at"`
+	UplinkMessage *V3UplinkMessage `json:"uplink_message"`
+}
+
+// Uplink converts a Things Stack uplink into the internal representation.
+func (m *MessageV3) Uplink() (*Uplink, error) {
+	up := m.UplinkMessage
+	if up == nil {
+		return nil, fmt.Errorf("message from %v has no uplink", m.EndDeviceIDs.DevID)
+	}
+	ts := up.ReceivedAt
+	if ts == "" {
+		ts = m.ReceivedAt
+	}
+	timeStamp, err := time.Parse(time.RFC3339Nano, ts)
+	if err != nil {
+		return nil, err
+	}
+
+	uplink := &Uplink{
+		AppID:      m.EndDeviceIDs.AppIDs.AppID,
+		DevID:      m.EndDeviceIDs.DevID,
+		HWSerial:   m.EndDeviceIDs.DevEUI,
+		Port:       up.FPort,
+		Counter:    up.FCnt,
+		PayloadRaw: up.FrmPayload,
+		Time:       timeStamp,
+		CodingRate: up.Settings.CodingRate,
+	}
+	if up.DecodedPayload != nil {
+		uplink.Payload = up.DecodedPayload.Payload()
+	}
+	if up.Settings.Frequency != "" {
+		hz, err := strconv.ParseFloat(up.Settings.Frequency, 64)
+		if err != nil {
+			return nil, err
+		}
+		uplink.Frequency = hz / 1e6
+	}
+	if lora := up.Settings.DataRate.LoRa; lora != nil {
+		uplink.Modulation = "LORA"
+		uplink.DataRate = fmt.Sprintf("SF%vBW%v", lora.SpreadingFactor, lora.Bandwidth/1000)
+		if lora.CodingRate != "" {
+			uplink.CodingRate = lora.CodingRate
+		}
+	}
+
+	for i := 0; i < len(up.RxMetadata); i++ {
+		rx := up.RxMetadata[i]
+		gw := &GwMetadata{
+			Timestamp: rx.Timestamp,
+			GtwID:     rx.GatewayIDs.GtwID,
+			Channel:   rx.ChannelIndex,
+			RSSI:      rx.RSSI,
+			SNR:       rx.SNR,
+			RFChain:   rx.RFChain,
+		}
+		if rx.Location != nil {
+			gw.Latitude = rx.Location.Latitude
+			gw.Longitude = rx.Location.Longitude
+			gw.Altitude = rx.Location.Altitude
+		}
+		uplink.Gateways = append(uplink.Gateways, gw)
+	}
+	return uplink, nil
+}
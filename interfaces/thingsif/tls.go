@@ -0,0 +1,119 @@
+package thingsif
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+)
+
+type TLSConfig struct {
+	// CAFile is a PEM bundle used instead of the system roots.
+	CAFile string
+	// CertFile and KeyFile hold the client certificate key pair.
+	CertFile           string
+	KeyFile            string
+	ServerName         string
+	InsecureSkipVerify bool
+}
+
+func isTLSScheme(scheme string) bool {
+	switch scheme {
+	case "ssl", "tls", "mqtts", "mqtt+ssl", "tcps", "wss":
+		return true
+	}
+	return false
+}
+
+func (t *TLSConfig) tlsConfig() (*tls.Config, error) {
+	conf := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			slog.Info("TLS negotiated", "version", tls.VersionName(cs.Version))
+			return nil
+		},
+	}
+	if t == nil {
+		return conf, nil
+	}
+	conf.ServerName = t.ServerName
+	conf.InsecureSkipVerify = t.InsecureSkipVerify
+	if t.InsecureSkipVerify {
+		slog.Warn("TLS certificate verification disabled")
+	}
+	if t.CAFile != "" {
+		pem, err := os.ReadFile(t.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA bundle: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA bundle %v", t.CAFile)
+		}
+		conf.RootCAs = pool
+	}
+	if t.CertFile != "" || t.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %v", err)
+		}
+		conf.Certificates = []tls.Certificate{cert}
+	}
+	return conf, nil
+}
+
+// brokerTLS returns the TLS configuration for the broker, or nil for
+// plain text brokers.
+func (mq *MQTTCli) brokerTLS(broker string) (*tls.Config, error) {
+	uri, err := url.Parse(broker)
+	if err != nil {
+		return nil, fmt.Errorf("invalid broker url: %v", err)
+	}
+	if !isTLSScheme(uri.Scheme) {
+		if mq.conf.TLS != nil {
+			return nil, fmt.Errorf("TLS configured but broker %v is not a TLS url", broker)
+		}
+		return nil, nil
+	}
+	return mq.conf.TLS.tlsConfig()
+}
+
+// dialTLS opens the broker connection itself so certificate errors can be
+// reported; paho flattens them into a generic network error.
+func (mq *MQTTCli) dialTLS(conf *tls.Config) MQTT.OpenConnectionFunc {
+	return func(uri *url.URL, options MQTT.ClientOptions) (net.Conn, error) {
+		dialer := &net.Dialer{Timeout: options.ConnectTimeout}
+		addr := tlsAddr(uri)
+		conn, err := tls.DialWithDialer(dialer, "tcp", addr, conf)
+		var verr *tls.CertificateVerificationError
+		if errors.As(err, &verr) {
+			err = fmt.Errorf("TLS certificate verification failed for %v: %v", addr, verr.Err)
+			slog.Error("TLS certificate verification failed", "host", addr, "err", verr.Err)
+			mq.certErr.Store(err)
+		}
+		return conn, err
+	}
+}
+
+// tlsAddr is the address of a TLS broker, on the MQTT over TLS port 8883
+// when the URL names none.
+func tlsAddr(uri *url.URL) string {
+	if uri.Port() == "" {
+		return net.JoinHostPort(uri.Hostname(), "8883")
+	}
+	return uri.Host
+}
+
+// connectError prefers a recorded certificate error over paho's error.
+func (mq *MQTTCli) connectError(err error) error {
+	if cerr, ok := mq.certErr.Load().(error); ok {
+		return cerr
+	}
+	return err
+}
@@ -0,0 +1,30 @@
+package thingsif
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestTLSAddr(t *testing.T) {
+	tests := []struct {
+		broker string
+		want   string
+	}{
+		{broker: "ssl://eu1.cloud.thethings.network", want: "eu1.cloud.thethings.network:8883"},
+		{broker: "tls://eu1.cloud.thethings.network:8884", want: "eu1.cloud.thethings.network:8884"},
+		{broker: "mqtts://10.0.0.1", want: "10.0.0.1:8883"},
+		{broker: "ssl://[::1]", want: "[::1]:8883"},
+		{broker: "ssl://[::1]:1883", want: "[::1]:1883"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.broker, func(t *testing.T) {
+			uri, err := url.Parse(tt.broker)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := tlsAddr(uri); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,86 @@
+package thingsif
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+const (
+	// FormatV2 selects the retired TTN v2 JSON message format.
+	FormatV2 = "v2"
+	// FormatV3 selects The Things Stack (v3) JSON message format.
+	FormatV3 = "v3"
+)
+
+// Uplink is the generation independent form of an uplink message.
+type Uplink struct {
+	AppID      string
+	DevID      string
+	HWSerial   string
+	Port       int
+	Counter    int
+	PayloadRaw string
+	// Payload is nil until the payload has been decoded.
+	Payload *Payload
+	Time    time.Time
+	// Received is when the getter received the uplink, zero for history.
+	Received   time.Time
+	Frequency  float64
+	Modulation string
+	DataRate   string
+	CodingRate string
+	Gateways   []*GwMetadata
+}
+
+// Uplink converts a TTN v2 uplink into the internal representation.
+func (m *Message) Uplink() (*Uplink, error) {
+	meta := m.Metadata
+	if meta == nil {
+		return nil, fmt.Errorf("message from %v has no metadata", m.DevID)
+	}
+	timeStamp, err := time.Parse(time.RFC3339Nano, meta.Time)
+	if err != nil {
+		return nil, err
+	}
+	uplink := &Uplink{
+		AppID:      m.AppID,
+		DevID:      m.DevID,
+		HWSerial:   m.HWSerial,
+		Port:       m.Port,
+		Counter:    m.Counter,
+		PayloadRaw: m.PayloadRaw,
+		Time:       timeStamp,
+		Frequency:  meta.Frequency,
+		Modulation: meta.Modulation,
+		DataRate:   meta.DataRate,
+		CodingRate: meta.CodingRate,
+		Gateways:   meta.Gateways,
+	}
+	if m.PayloadFields != nil {
+		uplink.Payload = m.PayloadFields.Payload()
+	}
+	return uplink, nil
+}
+
+// ParseUplink decodes an MQTT payload of the given format into an Uplink.
+// An empty format is treated as FormatV2.
+func ParseUplink(format string, data []byte) (*Uplink, error) {
+	switch format {
+	case "", FormatV2:
+		msg := &Message{}
+		err := json.Unmarshal(data, msg)
+		if err != nil {
+			return nil, err
+		}
+		return msg.Uplink()
+	case FormatV3:
+		msg := &MessageV3{}
+		err := json.Unmarshal(data, msg)
+		if err != nil {
+			return nil, err
+		}
+		return msg.Uplink()
+	}
+	return nil, fmt.Errorf("unknown message format: %v", format)
+}
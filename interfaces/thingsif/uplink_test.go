@@ -0,0 +1,150 @@
+package thingsif
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const uplinkV2 = `{
+	"app_id": "weather",
+	"dev_id": "node1",
+	"hardware_serial": "0004A30B001C0530",
+	"port": 1,
+	"counter": 42,
+	"payload_raw": "B9AXcA50/g==",
+	"payload_fields": {"valid": true, "temp": 20, "humd": 60, "bat": 3.7},
+	"metadata": {
+		"time": "2024-05-01T12:00:00.123456789Z",
+		"frequency": 868.1,
+		"modulation": "LORA",
+		"data_rate": "SF7BW125",
+		"coding_rate": "4/5",
+		"gateways": [
+			{"gtw_id": "gw1", "timestamp": 1000, "channel": 2, "rssi": -80, "snr": 7.5, "rf_chain": 1,
+			 "latitude": -33.93, "longitude": 18.86, "altitude": 120},
+			{"gtw_id": "gw2", "timestamp": 2000, "channel": 0, "rssi": -110, "snr": -3}
+		]
+	}
+}`
+
+const uplinkV3 = `{
+	"end_device_ids": {
+		"device_id": "node1",
+		"application_ids": {"application_id": "weather"},
+		"dev_eui": "0004A30B001C0530"
+	},
+	"received_at": "2024-05-01T12:00:01Z",
+	"uplink_message": {
+		"f_port": 1,
+		"f_cnt": 42,
+		"frm_payload": "B9AXcA50/g==",
+		"decoded_payload": {"valid": true, "temp": 20, "humd": 60, "bat": 3.7},
+		"received_at": "2024-05-01T12:00:00.123456789Z",
+		"settings": {
+			"data_rate": {"lora": {"bandwidth": 125000, "spreading_factor": 7, "coding_rate": "4/5"}},
+			"frequency": "868100000"
+		},
+		"rx_metadata": [
+			{"gateway_ids": {"gateway_id": "gw1"}, "timestamp": 1000, "channel_index": 2, "rssi": -80, "snr": 7.5,
+			 "rf_chain": 1, "location": {"latitude": -33.93, "longitude": 18.86, "altitude": 120}},
+			{"gateway_ids": {"gateway_id": "gw2"}, "timestamp": 2000, "channel_index": 0, "rssi": -110, "snr": -3}
+		]
+	}
+}`
+
+func TestParseUplink(t *testing.T) {
+	payload := &Payload{Valid: true}
+	payload.Add(MeasBattery, 3.7, "V")
+	payload.Add(MeasHumidity, 60, "%RH")
+	payload.Add(MeasTemperature, 20, "degC")
+	want := &Uplink{
+		AppID:      "weather",
+		DevID:      "node1",
+		HWSerial:   "0004A30B001C0530",
+		Port:       1,
+		Counter:    42,
+		PayloadRaw: "B9AXcA50/g==",
+		Payload:    payload,
+		Time:       time.Date(2024, 5, 1, 12, 0, 0, 123456789, time.UTC),
+		Frequency:  868.1,
+		Modulation: "LORA",
+		DataRate:   "SF7BW125",
+		CodingRate: "4/5",
+		Gateways: []*GwMetadata{
+			{GtwID: "gw1", Timestamp: 1000, Channel: 2, RSSI: -80, SNR: 7.5, RFChain: 1,
+				Latitude: -33.93, Longitude: 18.86, Altitude: 120},
+			{GtwID: "gw2", Timestamp: 2000, Channel: 0, RSSI: -110, SNR: -3},
+		},
+	}
+
+	// Without its own received_at the uplink takes the time of the
+	// message.
+	v3Outer := strings.Replace(uplinkV3, `"received_at": "2024-05-01T12:00:01Z",`, `"received_at": "2024-05-01T12:00:00.123456789Z",`, 1)
+	v3Outer = strings.Replace(v3Outer, `"received_at": "2024-05-01T12:00:00.123456789Z",
+		"settings"`, `"settings"`, 1)
+	if strings.Count(v3Outer, "received_at") != 1 {
+		t.Fatal("received_at of the uplink not removed from the fixture")
+	}
+
+	tests := []struct {
+		name   string
+		format string
+		data   string
+		want   *Uplink
+	}{
+		{"v2", FormatV2, uplinkV2, want},
+		{"default format", "", uplinkV2, want},
+		{"v3", FormatV3, uplinkV3, want},
+		{"v3 message time", FormatV3, v3Outer, want},
+		{"v2 without metadata", FormatV2, `{"dev_id": "node1"}`, nil},
+		{"v3 without uplink", FormatV3, `{"end_device_ids": {"device_id": "node1"}, "received_at": "2024-05-01T12:00:00Z"}`, nil},
+		{"v3 bad time", FormatV3, strings.ReplaceAll(uplinkV3, "2024-05-01T12:00:0", "yesterday "), nil},
+		{"v3 bad frequency", FormatV3, strings.Replace(uplinkV3, `"868100000"`, `"868.1 MHz"`, 1), nil},
+		{"bad json", FormatV3, `{`, nil},
+		{"unknown format", "v4", uplinkV3, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseUplink(tt.format, []byte(tt.data))
+			if tt.want == nil {
+				if err == nil {
+					t.Errorf("got %+v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestV3DataRate(t *testing.T) {
+	tests := []struct {
+		settings   V3TxSettings
+		modulation string
+		dataRate   string
+		codingRate string
+	}{
+		{V3TxSettings{DataRate: V3DataRate{LoRa: &V3LoRaDataRate{Bandwidth: 125000, SpreadingFactor: 12}}, CodingRate: "4/5"},
+			"LORA", "SF12BW125", "4/5"},
+		{V3TxSettings{DataRate: V3DataRate{LoRa: &V3LoRaDataRate{Bandwidth: 250000, SpreadingFactor: 7, CodingRate: "4/6"}}, CodingRate: "4/5"},
+			"LORA", "SF7BW250", "4/6"},
+		{V3TxSettings{CodingRate: "4/5"}, "", "", "4/5"},
+	}
+	for _, tt := range tests {
+		m := &MessageV3{ReceivedAt: "2024-05-01T12:00:00Z", UplinkMessage: &V3UplinkMessage{Settings: tt.settings}}
+		u, err := m.Uplink()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if u.Modulation != tt.modulation || u.DataRate != tt.dataRate || u.CodingRate != tt.codingRate {
+			t.Errorf("%+v: got %v %v %v", tt.settings, u.Modulation, u.DataRate, u.CodingRate)
+		}
+	}
+}